@@ -0,0 +1,500 @@
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/branthz/utarrow/lib/log"
+)
+
+const (
+	defaultCausalHistory = 1024
+	causalRetryInterval  = time.Second
+	maxCausalPending     = 4 * defaultCausalHistory // broadcasts buffered
+)
+
+// causalGossip implements GossipConfig.CausalBroadcast, standing between a
+// gossip channel and the application's Gossiper. Each broadcast is stamped
+// with a vector clock, counting for each source the broadcasts delivered
+// by the sender before it, and its own among them. A broadcast is
+// delivered once all it counts have been delivered; until then it is
+// buffered, up to maxCausalPending broadcasts, beyond which only those
+// deliverable straight away are accepted. Broadcasts are relayed as sent, whatever the application's
+// OnGossipBroadcast returns, and are never merged with each other.
+//
+// A broadcast buffered for longer than causalRetryInterval prompts
+// requests to the sources of the broadcasts it awaits, which retransmit
+// those they still have among their latest CausalHistory. Those they no
+// longer have, and those of sources which have left, are skipped. Sources
+// are distinguished by UID as well as name, so that a restarted peer
+// starts counting afresh. The entries of a peer's previous incarnations
+// are forgotten when it restarts, and all of its entries when it is GC'd.
+//
+// Every unicast and broadcast on the channel starts with a kind byte, and
+// a stamped broadcast continues with
+//
+//	uid          uvarint UID of the source, whose entry is its own count
+//	entries      uvarint count
+//	  source     peer name bytes, as for gossip msgs, and uvarint UID
+//	  delivered  uvarint
+//	payload      all remaining bytes
+type causalGossip struct {
+	router   *Router
+	gossip   QueryGossip // the channel
+	gossiper Gossiper    // the application's
+	history  int
+	self     causalSource
+	quit     <-chan struct{} // the channel's
+
+	deliverLock sync.Mutex // held while delivering, to deliver in order
+
+	sync.Mutex
+	delivered vectorClock
+	pending   map[causalSource]map[uint64]*causalMsg // by source and its count
+	buffered  int                                    // broadcasts in pending
+	sent      [][]byte                               // our latest broadcasts
+	sentBase  uint64                                 // the count of sent[0]
+}
+
+const (
+	causalBroadcast byte = iota
+	causalUnicast
+	causalRequest    // for the uvarint UID and range of counts of ours
+	causalRetransmit // of a broadcast, stamped
+	causalGone       // uvarint UID and the count before which we have none
+)
+
+type causalSource struct {
+	name PeerName
+	uid  PeerUID
+}
+
+type vectorClock map[causalSource]uint64
+
+type causalMsg struct {
+	clock   vectorClock
+	payload []byte
+	since   time.Time
+}
+
+func newCausalGossip(router *Router, g Gossiper, history int) *causalGossip {
+	if history <= 0 {
+		history = defaultCausalHistory
+	}
+	c := &causalGossip{
+		router:    router,
+		gossiper:  g,
+		history:   history,
+		self:      causalSource{router.Ourself.Name, router.Ourself.UID},
+		delivered: make(vectorClock),
+		pending:   make(map[causalSource]map[uint64]*causalMsg),
+		sentBase:  1,
+	}
+	router.Peers.OnGC(func(peer *Peer) { c.forget(peer.Name, 0) })
+	router.Peers.onMembership(func(event MembershipEvent) {
+		if event.Type == PeerRestarted {
+			c.forget(event.Peer, event.UID)
+		}
+	})
+	return c
+}
+
+// forget removes the entries, and any buffered broadcasts, of the named
+// peer's incarnations other than current, which is zero once the peer has
+// been GC'd. Should broadcasts stamped with a forgotten entry arrive
+// later, requestMissing skips what they await.
+func (c *causalGossip) forget(name PeerName, current PeerUID) {
+	c.Lock()
+	defer c.Unlock()
+	for source := range c.delivered {
+		if source.name == name && source.uid != current {
+			delete(c.delivered, source)
+		}
+	}
+	for source, msgs := range c.pending {
+		if source.name == name && source.uid != current {
+			c.buffered -= len(msgs)
+			delete(c.pending, source)
+		}
+	}
+}
+
+// GossipUnicast implements Gossip.
+func (c *causalGossip) GossipUnicast(dst PeerName, msg []byte) error {
+	return c.gossip.GossipUnicast(dst, append([]byte{causalUnicast}, msg...))
+}
+
+// GossipBroadcast implements Gossip.
+func (c *causalGossip) GossipBroadcast(update GossipData) {
+	c.gossip.GossipBroadcast(c.stamp(update))
+}
+
+// GossipNeighbourSubset implements Gossip.
+func (c *causalGossip) GossipNeighbourSubset(update GossipData) {
+	c.gossip.GossipNeighbourSubset(update)
+}
+
+// GossipQuery implements QueryGossip.
+func (c *causalGossip) GossipQuery(ctx context.Context, query []byte, onReply func(QueryReply)) ([]PeerName, error) {
+	return c.gossip.GossipQuery(ctx, query, onReply)
+}
+
+// stamp returns update as stamped broadcasts, one per encoded msg,
+// keeping them for retransmission.
+func (c *causalGossip) stamp(update GossipData) *causalData {
+	c.Lock()
+	defer c.Unlock()
+	data := &causalData{}
+	for _, msg := range update.Encode() {
+		c.delivered[c.self]++
+		buf := encodeCausal(c.self.uid, c.delivered, msg)
+		data.msgs = append(data.msgs, buf)
+		c.sent = append(c.sent, buf)
+		if len(c.sent) > c.history {
+			c.sent = c.sent[1:]
+			c.sentBase++
+		}
+	}
+	return data
+}
+
+// receive buffers a stamped broadcast from src, and delivers whatever that
+// makes deliverable. It reports whether the broadcast was new to us.
+func (c *causalGossip) receive(src PeerName, buf []byte) (bool, error) {
+	uid, clock, payload, err := decodeCausal(buf)
+	if err != nil {
+		return false, err
+	}
+	source := causalSource{src, uid}
+	count, found := clock[source]
+	if !found {
+		return false, fmt.Errorf("causal broadcast from %s missing its own count", src)
+	}
+
+	c.Lock()
+	_, buffered := c.pending[source][count]
+	isNew := count > c.delivered[source] && !buffered
+	// Once the buffer is full, those that would only wait in it are
+	// dropped, to be requested again once they are awaited.
+	if isNew && c.buffered >= maxCausalPending && !(count == c.delivered[source]+1 && c.delivered.covers(clock, source)) {
+		log.Info("[gossip] too many causal broadcasts buffered; dropping one from %s", src)
+		isNew = false
+	}
+	if isNew {
+		if c.pending[source] == nil {
+			c.pending[source] = make(map[uint64]*causalMsg)
+		}
+		c.pending[source][count] = &causalMsg{clock: clock, payload: payload, since: time.Now()}
+		c.buffered++
+	}
+	c.Unlock()
+
+	if isNew {
+		c.deliverReady()
+	}
+	return isNew, nil
+}
+
+// deliverReady delivers buffered broadcasts until none is deliverable.
+func (c *causalGossip) deliverReady() {
+	c.deliverLock.Lock()
+	defer c.deliverLock.Unlock()
+	for {
+		c.Lock()
+		source, m := c.nextDeliverable()
+		c.Unlock()
+		if m == nil {
+			return
+		}
+		if _, err := c.gossiper.OnGossipBroadcast(source.name, m.payload); err != nil {
+			log.Info("[gossip] error delivering causal broadcast from %s: %v", source.name, err)
+		}
+	}
+}
+
+// nextDeliverable removes a deliverable broadcast from the buffer, and
+// counts it as delivered. Must hold the lock.
+func (c *causalGossip) nextDeliverable() (causalSource, *causalMsg) {
+	for source, msgs := range c.pending {
+		m, found := msgs[c.delivered[source]+1]
+		if !found {
+			continue
+		}
+		if c.delivered.covers(m.clock, source) {
+			delete(msgs, c.delivered[source]+1)
+			c.buffered--
+			if len(msgs) == 0 {
+				delete(c.pending, source)
+			}
+			c.delivered[source]++
+			return source, m
+		}
+	}
+	return causalSource{}, nil
+}
+
+func (c *causalGossip) retryLoop() {
+	defer c.router.untrack()
+	ticker := time.NewTicker(causalRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.requestMissing(now)
+		case <-c.router.quit:
+			return
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// requestMissing requests the broadcasts awaited by those buffered for
+// longer than causalRetryInterval, skipping those of sources which have
+// left.
+func (c *causalGossip) requestMissing(now time.Time) {
+	c.Lock()
+	awaited := make(vectorClock)
+	for source, msgs := range c.pending {
+		for _, m := range msgs {
+			if now.Sub(m.since) < causalRetryInterval {
+				continue
+			}
+			for s, n := range m.clock {
+				if s == source {
+					n-- // awaiting those before it, not itself
+				}
+				if n > awaited[s] {
+					awaited[s] = n
+				}
+			}
+		}
+	}
+	requests := make(map[causalSource][2]uint64)
+	skipped := false
+	for source, upTo := range awaited {
+		if upTo <= c.delivered[source] || source == c.self {
+			continue
+		}
+		if peer := c.router.Peers.Fetch(source.name); peer == nil || peer.UID != source.uid {
+			log.Info("[gossip] skipping causal broadcasts %d-%d from departed %s", c.delivered[source]+1, upTo, source.name)
+			c.delivered[source] = upTo
+			skipped = true
+			continue
+		}
+		requests[source] = [2]uint64{c.delivered[source] + 1, upTo}
+	}
+	c.Unlock()
+
+	if skipped {
+		c.deliverReady()
+	}
+	for source, span := range requests {
+		msg := makeCausalControlMsg(causalRequest, uint64(source.uid), span[0], span[1])
+		if err := c.gossip.GossipUnicast(source.name, msg); err != nil {
+			log.Debug("[gossip] unable to request causal broadcasts from %s: %v", source.name, err)
+		}
+	}
+}
+
+// retransmit answers a request from src for our broadcasts from..to.
+func (c *causalGossip) retransmit(src PeerName, uid PeerUID, from, to uint64) {
+	c.Lock()
+	base := c.sentBase
+	if uid != c.self.uid { // for a previous incarnation of ours
+		base = to + 1
+	}
+	start := from
+	if start < base {
+		start = base
+	}
+	var msgs [][]byte
+	for count := start; count <= to && count-base < uint64(len(c.sent)); count++ {
+		msgs = append(msgs, c.sent[count-base])
+	}
+	c.Unlock()
+
+	if from < base {
+		if err := c.gossip.GossipUnicast(src, makeCausalControlMsg(causalGone, uint64(uid), base)); err != nil {
+			log.Debug("[gossip] unable to answer %s: %v", src, err)
+			return
+		}
+	}
+	for _, msg := range msgs {
+		if err := c.gossip.GossipUnicast(src, append([]byte{causalRetransmit}, msg...)); err != nil {
+			log.Debug("[gossip] unable to retransmit to %s: %v", src, err)
+			return
+		}
+	}
+}
+
+// skip gives up on the broadcasts of source before base, which it no
+// longer has.
+func (c *causalGossip) skip(source causalSource, base uint64) {
+	c.Lock()
+	skipped := base > 0 && c.delivered[source] < base-1
+	if skipped {
+		log.Info("[gossip] skipping causal broadcasts %d-%d from %s, no longer held", c.delivered[source]+1, base-1, source.name)
+		c.delivered[source] = base - 1
+	}
+	c.Unlock()
+	if skipped {
+		c.deliverReady()
+	}
+}
+
+// OnGossipUnicast implements Gossiper.
+func (c *causalGossip) OnGossipUnicast(src PeerName, msg []byte) error {
+	if len(msg) < 1 {
+		return fmt.Errorf("empty causal msg from %s", src)
+	}
+	kind, body := msg[0], msg[1:]
+	switch kind {
+	case causalUnicast:
+		return c.gossiper.OnGossipUnicast(src, body)
+	case causalRetransmit:
+		_, err := c.receive(src, body)
+		return err
+	case causalRequest:
+		nums, _, err := readUvarints(body, 3)
+		if err != nil {
+			return err
+		}
+		c.retransmit(src, PeerUID(nums[0]), nums[1], nums[2])
+		return nil
+	case causalGone:
+		nums, _, err := readUvarints(body, 2)
+		if err != nil {
+			return err
+		}
+		c.skip(causalSource{src, PeerUID(nums[0])}, nums[1])
+		return nil
+	}
+	return fmt.Errorf("unknown causal msg kind %d from %s", kind, src)
+}
+
+// OnGossipBroadcast implements Gossiper, relaying only broadcasts new to
+// us.
+func (c *causalGossip) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	if len(update) < 1 || update[0] != causalBroadcast {
+		return nil, fmt.Errorf("malformed causal broadcast from %s", src)
+	}
+	isNew, err := c.receive(src, update[1:])
+	if err != nil || !isNew {
+		return nil, err
+	}
+	return &causalData{[][]byte{update[1:]}}, nil
+}
+
+// Gossip implements Gossiper.
+func (c *causalGossip) Gossip() GossipData {
+	return c.gossiper.Gossip()
+}
+
+// OnGossip implements Gossiper.
+func (c *causalGossip) OnGossip(msg []byte) (GossipData, error) {
+	return c.gossiper.OnGossip(msg)
+}
+
+// OnGossipQuery implements QueryGossiper, if the application's Gossiper
+// does.
+func (c *causalGossip) OnGossipQuery(src PeerName, query []byte) ([]byte, error) {
+	if gossiper, ok := c.gossiper.(QueryGossiper); ok {
+		return gossiper.OnGossipQuery(src, query)
+	}
+	return nil, fmt.Errorf("queries not supported")
+}
+
+// causalData is a list of stamped broadcasts. Merging concatenates them.
+type causalData struct {
+	msgs [][]byte
+}
+
+func (d *causalData) Encode() [][]byte {
+	bufs := make([][]byte, len(d.msgs))
+	for i, msg := range d.msgs {
+		bufs[i] = append([]byte{causalBroadcast}, msg...)
+	}
+	return bufs
+}
+
+func (d *causalData) Merge(other GossipData) GossipData {
+	msgs := make([][]byte, 0, len(d.msgs)+len(other.(*causalData).msgs))
+	return &causalData{append(append(msgs, d.msgs...), other.(*causalData).msgs...)}
+}
+
+// covers reports whether clock has delivered all that other counts,
+// except for from, the source of other.
+func (clock vectorClock) covers(other vectorClock, from causalSource) bool {
+	for source, n := range other {
+		if source != from && n > clock[source] {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeCausal(uid PeerUID, clock vectorClock, payload []byte) []byte {
+	var buf []byte
+	buf = appendUvarint(buf, uint64(uid))
+	buf = appendUvarint(buf, uint64(len(clock)))
+	for source, n := range clock {
+		buf = appendBytes(buf, source.name.bytes())
+		buf = appendUvarint(buf, uint64(source.uid))
+		buf = appendUvarint(buf, n)
+	}
+	return append(buf, payload...)
+}
+
+func decodeCausal(buf []byte) (PeerUID, vectorClock, []byte, error) {
+	nums, buf, err := readUvarints(buf, 2)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	uid, entries := PeerUID(nums[0]), nums[1]
+	if entries > uint64(len(buf)) {
+		return 0, nil, nil, errMalformedGossip
+	}
+	clock := make(vectorClock, entries)
+	for i := uint64(0); i < entries; i++ {
+		name, rest, err := readBytes(buf)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if nums, buf, err = readUvarints(rest, 2); err != nil {
+			return 0, nil, nil, err
+		}
+		clock[causalSource{PeerNameFromBin(name), PeerUID(nums[0])}] = nums[1]
+	}
+	return uid, clock, buf, nil
+}
+
+func makeCausalControlMsg(kind byte, nums ...uint64) []byte {
+	buf := []byte{kind}
+	for _, n := range nums {
+		buf = appendUvarint(buf, n)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+// readUvarints reads count uvarints from the start of buf, returning them
+// and the rest of buf.
+func readUvarints(buf []byte, count int) ([]uint64, []byte, error) {
+	nums := make([]uint64, count)
+	for i := range nums {
+		n, l := binary.Uvarint(buf)
+		if l <= 0 {
+			return nil, nil, errMalformedGossip
+		}
+		nums[i], buf = n, buf[l:]
+	}
+	return nums, buf, nil
+}
@@ -0,0 +1,167 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// broadcastRecorder records the broadcasts it receives, in order.
+type broadcastRecorder struct {
+	*testGossiper
+	received chan<- string
+}
+
+func (g *broadcastRecorder) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	g.received <- string(update)
+	return nil, nil
+}
+
+func newCausalTestRouter(t *testing.T, network *MemTransport, i int) (*Router, *causalGossip, <-chan string) {
+	name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+	require.NoError(t, err)
+	router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+	require.NoError(t, err)
+	received := make(chan string, 16)
+	gossip, err := router.NewGossipWithConfig("causal", &broadcastRecorder{newTestGossiper(), received}, GossipConfig{CausalBroadcast: true})
+	require.NoError(t, err)
+	return router, gossip.(*causalGossip), received
+}
+
+func requireReceived(t *testing.T, received <-chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case r := <-received:
+			require.Equal(t, e, r)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for "+e)
+		}
+	}
+	select {
+	case r := <-received:
+		require.FailNow(t, "unexpected "+r)
+	default:
+	}
+}
+
+func TestCausalBroadcastOrder(t *testing.T) {
+	router, c, received := newCausalTestRouter(t, NewMemTransport(), 1)
+	defer router.Stop(context.Background())
+
+	aName, _ := PeerNameFromString("02:00:00:00:00:01")
+	bName, _ := PeerNameFromString("03:00:00:00:00:01")
+	a, b := causalSource{aName, 1}, causalSource{bName, 1}
+	msg := func(src causalSource, clock vectorClock, payload string) []byte {
+		return append([]byte{causalBroadcast}, encodeCausal(src.uid, clock, []byte(payload))...)
+	}
+
+	// b2 follows b1, which follows a2, which follows a1.
+	for _, m := range []struct {
+		src     causalSource
+		clock   vectorClock
+		payload string
+	}{
+		{b, vectorClock{a: 2, b: 2}, "b2"},
+		{b, vectorClock{a: 2, b: 1}, "b1"},
+		{a, vectorClock{a: 2}, "a2"},
+	} {
+		data, err := c.OnGossipBroadcast(m.src.name, msg(m.src, m.clock, m.payload))
+		require.NoError(t, err)
+		require.NotNil(t, data, "new broadcasts are relayed")
+	}
+	requireReceived(t, received)
+
+	data, err := c.OnGossipBroadcast(a.name, msg(a, vectorClock{a: 1}, "a1"))
+	require.NoError(t, err)
+	require.NotNil(t, data)
+	requireReceived(t, received, "a1", "a2", "b1", "b2")
+
+	data, err = c.OnGossipBroadcast(a.name, msg(a, vectorClock{a: 1}, "a1"))
+	require.NoError(t, err)
+	require.Nil(t, data, "duplicates are not relayed")
+	requireReceived(t, received)
+
+	_, err = c.OnGossipBroadcast(a.name, msg(a, vectorClock{b: 3}, "a3"))
+	require.Error(t, err, "missing its own count")
+
+	// A restarted a counts afresh, whatever its clock holds of before.
+	restarted := causalSource{aName, 2}
+	_, err = c.OnGossipBroadcast(a.name, msg(restarted, vectorClock{a: 2, restarted: 1}, "a'1"))
+	require.NoError(t, err)
+	requireReceived(t, received, "a'1")
+
+	// Once the buffer is full, only what can be delivered straight away
+	// is accepted.
+	c.Lock()
+	c.buffered = maxCausalPending
+	c.Unlock()
+	data, err = c.OnGossipBroadcast(b.name, msg(b, vectorClock{a: 2, b: 4}, "b4"))
+	require.NoError(t, err)
+	require.Nil(t, data, "dropped")
+	data, err = c.OnGossipBroadcast(b.name, msg(b, vectorClock{a: 2, b: 3}, "b3"))
+	require.NoError(t, err)
+	require.NotNil(t, data)
+	requireReceived(t, received, "b3")
+}
+
+func TestCausalBroadcastRetransmit(t *testing.T) {
+	network := NewMemTransport()
+	r1, c1, _ := newCausalTestRouter(t, network, 1)
+	r2, _, received := newCausalTestRouter(t, network, 2)
+	for _, router := range []*Router{r1, r2} {
+		require.NoError(t, router.Start())
+		defer router.Stop(context.Background())
+	}
+	r2.ConnectionMaker.InitiateConnections([]string{r1.Addr().String()}, true)
+	waitFor(t, "routes", func() bool {
+		return len(r1.Routes.BroadcastAll(r1.Ourself.Name)) == 1
+	})
+
+	c1.GossipBroadcast(newSurrogateGossipData([]byte("m1")))
+	requireReceived(t, received, "m1")
+
+	// m2 is lost, so m3 waits until r2 asks r1 to retransmit it.
+	c1.stamp(newSurrogateGossipData([]byte("m2")))
+	c1.GossipBroadcast(newSurrogateGossipData([]byte("m3")))
+	requireReceived(t, received, "m2", "m3")
+}
+
+func TestCausalBroadcastForget(t *testing.T) {
+	network := NewMemTransport()
+	r1, c1, _ := newCausalTestRouter(t, network, 1)
+	r2, c2, received := newCausalTestRouter(t, network, 2)
+	require.NoError(t, r1.Start())
+	require.NoError(t, r2.Start())
+	defer r2.Stop(context.Background())
+	r2.ConnectionMaker.InitiateConnections([]string{r1.Addr().String()}, true)
+	waitFor(t, "routes", func() bool {
+		return len(r1.Routes.BroadcastAll(r1.Ourself.Name)) == 1
+	})
+
+	c1.GossipBroadcast(newSurrogateGossipData([]byte("m1")))
+	requireReceived(t, received, "m1")
+	entries := func() int {
+		c2.Lock()
+		defer c2.Unlock()
+		return len(c2.delivered)
+	}
+	require.Equal(t, 1, entries())
+
+	// Once r1 has gone and been GC'd, its entry is forgotten.
+	require.NoError(t, r1.Stop(context.Background()))
+	waitFor(t, "entry forgotten", func() bool { return entries() == 0 })
+
+	// On a restart, only the entries of previous incarnations are.
+	restarted := causalSource{r1.Ourself.Name, r1.Ourself.UID + 1}
+	c2.Lock()
+	c2.delivered[causalSource{r1.Ourself.Name, r1.Ourself.UID}] = 1
+	c2.delivered[restarted] = 1
+	c2.Unlock()
+	c2.forget(restarted.name, restarted.uid)
+	c2.Lock()
+	defer c2.Unlock()
+	require.Equal(t, vectorClock{restarted: 1}, c2.delivered)
+}
@@ -0,0 +1,110 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Connections whose remote has the "Chunking" feature send protocol msgs
+// larger than chunkSize as a series of ProtocolChunk msgs, each of which
+// is
+//
+//	msg ID      uvarint, distinguishing the msg from others being chunked
+//	msg size    uvarint, the size of the whole msg
+//	fragment    all remaining bytes
+//
+// The fragments of a msg are sent in order, and once reassembled the msg
+// starts with its own tag. Fragments may be interleaved with other msgs,
+// so that heartbeats and small gossip are not held up behind large
+// gossip. No msg may exceed Config.MaxMessageSize, nor may the msgs being
+// reassembled together, so a connection sends one chunked msg at a time.
+// Fragments of different msgs are nonetheless told apart, should a remote
+// interleave them.
+const (
+	chunkSize             = 1024 * 1024
+	maxPendingChunkedMsgs = 16
+	defaultMaxMessageSize = 128 * 1024 * 1024
+
+	// The largest msg which fits in a single frame, encrypted or not.
+	maxUnchunkedMsgSize = maxTCPMsgSize - secretbox.Overhead
+)
+
+// messageTooLargeError is returned when sending a msg larger than we, or
+// the remote, can handle. Unlike other send errors, it does not break the
+// connection.
+type messageTooLargeError struct {
+	size, max int
+}
+
+func (err *messageTooLargeError) Error() string {
+	return fmt.Sprintf("outgoing message exceeds maximum size: %d > %d", err.size, err.max)
+}
+
+func isMessageTooLarge(err error) bool {
+	_, ok := err.(*messageTooLargeError)
+	return ok
+}
+
+// chunkHeader returns the header of a ProtocolChunk msg.
+func chunkHeader(id uint64, size int) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+chunkSize)
+	buf[0] = ProtocolChunk
+	n := 1 + binary.PutUvarint(buf[1:], id)
+	n += binary.PutUvarint(buf[n:], uint64(size))
+	return buf[:n]
+}
+
+// reassembler puts chunked msgs back together. It is not safe for
+// concurrent use.
+type reassembler struct {
+	maxSize     int
+	pending     map[uint64][]byte
+	pendingSize uint64 // the sum of the sizes of the pending msgs
+}
+
+// add adds the fragment in a ProtocolChunk msg payload, returning the
+// reassembled msg once it is complete.
+func (r *reassembler) add(payload []byte) ([]byte, error) {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errMalformedChunk
+	}
+	payload = payload[n:]
+	size, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errMalformedChunk
+	}
+	payload = payload[n:]
+	if size > uint64(r.maxSize) {
+		return nil, fmt.Errorf("incoming chunked message exceeds maximum size: %d > %d", size, r.maxSize)
+	}
+
+	msg, found := r.pending[id]
+	if uint64(len(msg)+len(payload)) > size {
+		return nil, errMalformedChunk
+	}
+	if !found {
+		if r.pending == nil {
+			r.pending = make(map[uint64][]byte)
+		}
+		if len(r.pending) >= maxPendingChunkedMsgs {
+			return nil, fmt.Errorf("too many chunked messages in progress")
+		}
+		if r.pendingSize+size > uint64(r.maxSize) {
+			return nil, fmt.Errorf("incoming chunked messages in progress exceed maximum size: %d > %d", r.pendingSize+size, r.maxSize)
+		}
+		r.pendingSize += size
+	}
+	msg = append(msg, payload...)
+	if uint64(len(msg)) < size {
+		r.pending[id] = msg
+		return nil, nil
+	}
+	delete(r.pending, id)
+	r.pendingSize -= size
+	return msg, nil
+}
+
+var errMalformedChunk = fmt.Errorf("malformed chunked msg")
@@ -0,0 +1,95 @@
+package mesh
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func chunk(id uint64, msg []byte, from, to int) []byte {
+	return append(chunkHeader(id, len(msg)), msg[from:to]...)[1:]
+}
+
+func TestReassembler(t *testing.T) {
+	r := reassembler{maxSize: 100}
+	a, b := []byte("aaaaaaaaaa"), []byte("bbbbbbbbbb")
+
+	// Interleaved msgs
+	for _, step := range []struct {
+		payload  []byte
+		expected []byte
+	}{
+		{chunk(1, a, 0, 4), nil},
+		{chunk(2, b, 0, 5), nil},
+		{chunk(1, a, 4, 8), nil},
+		{chunk(2, b, 5, 10), b},
+		{chunk(1, a, 8, 10), a},
+	} {
+		msg, err := r.add(step.payload)
+		require.NoError(t, err)
+		require.Equal(t, step.expected, msg)
+	}
+	require.Empty(t, r.pending)
+
+	_, err := r.add(chunk(3, make([]byte, 101), 0, 10))
+	require.Error(t, err, "too large")
+	_, err = r.add(append(chunk(4, a, 0, 10), 'x'))
+	require.Error(t, err, "overflow")
+	_, err = r.add([]byte{0x80})
+	require.Error(t, err, "malformed")
+
+	r = reassembler{maxSize: 1000}
+	for id := uint64(0); id < maxPendingChunkedMsgs; id++ {
+		_, err = r.add(chunk(id, a, 0, 1))
+		require.NoError(t, err)
+	}
+	_, err = r.add(chunk(maxPendingChunkedMsgs, a, 0, 1))
+	require.Error(t, err, "too many pending")
+
+	r = reassembler{maxSize: 100}
+	_, err = r.add(chunk(1, make([]byte, 60), 0, 1))
+	require.NoError(t, err)
+	_, err = r.add(chunk(2, make([]byte, 60), 0, 1))
+	require.Error(t, err, "too large in total")
+	_, err = r.add(chunk(3, make([]byte, 40), 0, 1))
+	require.NoError(t, err)
+}
+
+func TestRouterChunking(t *testing.T) {
+	const maxSize = 3 * maxTCPMsgSize
+	network := NewMemTransport()
+	newRouter := func(host, name string) *Router {
+		peerName, err := PeerNameFromString(name)
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: host, Port: Port, Transport: network, MaxMessageSize: maxSize}, peerName, host, nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		return router
+	}
+	r1 := newRouter("10.0.0.1", "01:00:00:01:00:00")
+	r2 := newRouter("10.0.0.2", "02:00:00:02:00:00")
+	defer func() {
+		for _, router := range []*Router{r1, r2} {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	received := make(chan []byte, 1)
+	gossip, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", &unicastRecorder{newTestGossiper(), received})
+	require.NoError(t, err)
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+
+	// Random, so that compression does not shrink it into a single frame.
+	big := make([]byte, 2*maxTCPMsgSize)
+	_, err = rand.Read(big)
+	require.NoError(t, err)
+	waitFor(t, "route", func() bool { return gossip.GossipUnicast(r2.Ourself.Name, big) == nil })
+	require.Equal(t, big, <-received)
+
+	err = gossip.GossipUnicast(r2.Ourself.Name, make([]byte, maxSize))
+	require.True(t, isMessageTooLarge(err), "got %v", err)
+	require.Equal(t, 1, r1.Ourself.connectionCount(), "the connection should survive")
+}
@@ -0,0 +1,99 @@
+package mesh
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Connections whose remote lists "deflate" in its "Compression" feature
+// send protocol msgs of at least Config.CompressionThreshold bytes
+// deflated, wrapped in a ProtocolCompressed msg, if that makes them
+// smaller. Compression happens before encryption.
+const (
+	compressionDeflate          = "deflate"
+	defaultCompressionThreshold = 1024
+)
+
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+// supportsDeflate reports whether the value of a "Compression" feature,
+// a comma-separated list, includes deflate.
+func supportsDeflate(feature string) bool {
+	for _, algorithm := range strings.Split(feature, ",") {
+		if algorithm == compressionDeflate {
+			return true
+		}
+	}
+	return false
+}
+
+// deflate appends msg, compressed, to dst. It returns nil if that would
+// not be shorter than appending msg itself.
+func deflate(dst, msg []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(msg); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if buf.Len()-len(dst) >= len(msg) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// inflater decompresses what deflate compressed, reusing its state
+// between msgs. It is not safe for concurrent use.
+type inflater struct {
+	reader io.ReadCloser
+}
+
+// inflate decompresses msg, refusing to produce more than maxSize bytes.
+func (i *inflater) inflate(msg []byte, maxSize int) ([]byte, error) {
+	if i.reader == nil {
+		i.reader = flate.NewReader(bytes.NewReader(msg))
+	} else if err := i.reader.(flate.Resetter).Reset(bytes.NewReader(msg), nil); err != nil {
+		return nil, err
+	}
+	inflated, err := ioutil.ReadAll(io.LimitReader(i.reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > maxSize {
+		return nil, fmt.Errorf("incoming compressed message exceeds maximum size: > %d", maxSize)
+	}
+	return inflated, nil
+}
+
+// compressionStats counts the bytes of the msgs sent on a connection,
+// before and after compression.
+type compressionStats struct {
+	before, after uint64 // accessed atomically
+}
+
+func (s *compressionStats) add(before, after int) {
+	atomic.AddUint64(&s.before, uint64(before))
+	atomic.AddUint64(&s.after, uint64(after))
+}
+
+func (s *compressionStats) get() (before, after uint64) {
+	return atomic.LoadUint64(&s.before), atomic.LoadUint64(&s.after)
+}
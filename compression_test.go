@@ -0,0 +1,91 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeflate(t *testing.T) {
+	msg := bytes.Repeat([]byte("gossip "), 1000)
+	deflated := deflate([]byte{ProtocolCompressed}, msg)
+	require.NotNil(t, deflated)
+	require.Equal(t, byte(ProtocolCompressed), deflated[0])
+	require.True(t, len(deflated) < len(msg)/10)
+
+	var i inflater
+	for n := 0; n < 2; n++ { // the second time round, the inflater is reset
+		inflated, err := i.inflate(deflated[1:], maxTCPMsgSize)
+		require.NoError(t, err)
+		require.Equal(t, msg, inflated)
+	}
+
+	random := make([]byte, 1000)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	require.Nil(t, deflate(nil, random), "incompressible msgs should be left alone")
+
+	bomb := deflate(nil, make([]byte, maxTCPMsgSize+1))
+	_, err = i.inflate(bomb, maxTCPMsgSize)
+	require.Error(t, err)
+
+	require.True(t, supportsDeflate("snappy,deflate"))
+	require.False(t, supportsDeflate(""))
+}
+
+func TestRouterCompression(t *testing.T) {
+	network := NewMemTransport()
+	newRouter := func(host, name string, threshold int) *Router {
+		peerName, err := PeerNameFromString(name)
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: host, Port: Port, Transport: network, CompressionThreshold: threshold}, peerName, host, nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		return router
+	}
+	r1 := newRouter("10.0.0.1", "01:00:00:01:00:00", 0)
+	r2 := newRouter("10.0.0.2", "02:00:00:02:00:00", 0)
+	r3 := newRouter("10.0.0.3", "03:00:00:03:00:00", -1)
+	defer func() {
+		for _, router := range []*Router{r1, r2, r3} {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String(), r3.Addr().String()}, true)
+	waitFor(t, "connections", func() bool { return r1.Ourself.connectionCount() == 2 })
+
+	received := make(chan []byte, 1)
+	gossip, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", &unicastRecorder{newTestGossiper(), received})
+	require.NoError(t, err)
+	big := bytes.Repeat([]byte("gossip "), 100*defaultCompressionThreshold)
+	waitFor(t, "route", func() bool { return gossip.GossipUnicast(r2.Ourself.Name, big) == nil })
+	require.Equal(t, big, <-received)
+
+	for conn := range r1.Ourself.getConnections() {
+		lc := conn.(*LocalConnection)
+		require.NoError(t, lc.SendProtocolMsg(protocolMsg{ProtocolHeartbeat, big}))
+	}
+	for _, status := range NewStatus(r1).Connections {
+		require.True(t, status.BytesBeforeCompression > uint64(len(big)))
+		if status.Compression == "" {
+			require.Equal(t, status.BytesBeforeCompression, status.BytesAfterCompression, "r3 disabled compression")
+		} else {
+			require.True(t, status.BytesAfterCompression < status.BytesBeforeCompression/10)
+		}
+	}
+}
+
+type unicastRecorder struct {
+	*testGossiper
+	received chan<- []byte
+}
+
+func (g *unicastRecorder) OnGossipUnicast(_ PeerName, msg []byte) error {
+	g.received <- msg
+	return nil
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/branthz/utarrow/lib/log"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Connection describes a link between peers.
@@ -18,6 +21,7 @@ type Connection interface {
 	remoteTCPAddress() string
 	isOutbound() bool
 	isEstablished() bool
+	rtt() time.Duration // zero if unmeasured
 }
 
 type ourConnection interface {
@@ -36,6 +40,7 @@ type remoteConnection struct {
 	remoteTCPAddr string
 	outbound      bool
 	established   bool
+	roundTrip     time.Duration // as gossiped
 }
 
 func newRemoteConnection(from, to *Peer, tcpAddr string, outbound bool, established bool) *remoteConnection {
@@ -58,21 +63,50 @@ func (conn *remoteConnection) isOutbound() bool { return conn.outbound }
 
 func (conn *remoteConnection) isEstablished() bool { return conn.established }
 
+func (conn *remoteConnection) rtt() time.Duration { return conn.roundTrip }
+
 // LocalConnection is the local (our) side of a connection.
 // It implements ProtocolSender, and manages per-channel GossipSenders.
 type LocalConnection struct {
+	// Accessed atomically, so first for alignment on 32-bit platforms.
+	compression compressionStats
+	chunkID     uint64
+	rttNanos    int64 // as gossiped; see handleHeartbeatEcho
+	established int32 // non-zero once the overlay connection is established
+
 	OverlayConn OverlayConnection
 
 	remoteConnection
-	tcpConn         *net.TCPConn
+	netConn         net.Conn
 	trustRemote     bool // is remote on a trusted subnet?
 	trustedByRemote bool // does remote trust us?
 	version         byte
 	tcpSender       tcpSender
 	sessionKey      *[32]byte
 	heartbeatTCP    *time.Ticker
+	heartbeats      *phiAccrual // arrival of the remote's heartbeats, and all else
+	echoes          bool        // whether the remote echoes heartbeats
+	echoChan        chan []byte // echoes for the actor to send
+	rttSamples      rttSamples  // only accessed by receiveTCP
+	created         time.Time
+	phiCheck        *time.Ticker // only with a Config.PhiThreshold
 	router          *Router
 	uid             uint64
+	identityKey     ed25519.PublicKey // remote's proven identity, if any
+	passwordIndex   int               // of the password the remote encrypts with; see LocalConnectionStatus
+	cryptoSender    *encryptedTCPSender
+	cryptoReceiver  *encryptedTCPReceiver
+	rekeying        bool // whether the remote supports rekeying
+	rekeyChan       chan func() error
+	codec           gossipCodec
+	compressing     bool        // whether we compress what we send
+	inflater        inflater    // only accessed by receiveTCP
+	chunking        bool        // whether the remote reassembles chunked msgs
+	chunkLock       sync.Mutex  // held while sending a chunked msg
+	maxMessageSize  int         // the largest msg both we and the remote accept
+	reassembler     reassembler // only accessed by receiveTCP
+	digests         bool        // whether the remote exchanges gossip digests
+	queries         bool        // whether the remote relays and answers gossip queries
 	errorChan       chan<- error
 	finished        <-chan struct{} // closed to signal that actorLoop has finished
 	senders         *gossipSenders
@@ -80,7 +114,7 @@ type LocalConnection struct {
 
 // If the connection is successful, it will end up in the local peer's
 // connections map.
-func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, router *Router, acceptNewPeer bool) {
+func startLocalConnection(connRemote *remoteConnection, netConn net.Conn, router *Router, acceptNewPeer bool) {
 	if connRemote.local != router.Ourself.Peer {
 		panic("attempt to create local connection from a peer which is not ourself")
 	}
@@ -89,13 +123,21 @@ func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, ro
 	conn := &LocalConnection{
 		remoteConnection: *connRemote, // NB, we're taking a copy of connRemote here.
 		router:           router,
-		tcpConn:          tcpConn,
+		netConn:          netConn,
 		trustRemote:      router.trusts(connRemote),
 		uid:              randUint64(),
+		heartbeats:       newPhiAccrual(tcpHeartbeat, time.Now()),
+		created:          time.Now(),
 		errorChan:        errorChan,
 		finished:         finished,
 	}
-	conn.senders = newGossipSenders(conn, finished)
+	conn.senders = newGossipSenders(conn, router.GossipQueueBytes, finished)
+	if !router.addLocalConnection(conn) {
+		if err := netConn.Close(); err != nil {
+			log.Info("warning: %v", err)
+		}
+		return
+	}
 	go conn.run(errorChan, finished, acceptNewPeer)
 }
 
@@ -117,15 +159,24 @@ func (conn *LocalConnection) breakTie(dupConn ourConnection) connectionTieBreak
 }
 
 // Established returns true if the connection is established.
-// TODO(pb): data race?
 func (conn *LocalConnection) isEstablished() bool {
-	return conn.established
+	return atomic.LoadInt32(&conn.established) != 0
 }
 
-// SendProtocolMsg implements ProtocolSender.
+// SendProtocolMsg implements ProtocolSender. A msg too large to send is
+// rejected, but other errors break the connection.
 func (conn *LocalConnection) SendProtocolMsg(m protocolMsg) error {
-	if err := conn.sendProtocolMsg(m); err != nil {
-		conn.shutdown(err)
+	return conn.sendInTurns(m, nil)
+}
+
+// sendInTurns implements turnTakingSender. It is SendProtocolMsg, taking
+// a turn for each frame, so that other gossip is sent between the chunks
+// of a large msg. Being given no turn does not break the connection.
+func (conn *LocalConnection) sendInTurns(m protocolMsg, turns *gossipTurns) error {
+	if err := conn.sendProtocolMsgInTurns(m, turns); err != nil {
+		if !isMessageTooLarge(err) && err != errNoTurn {
+			conn.shutdown(err)
+		}
 		return err
 	}
 	return nil
@@ -142,6 +193,19 @@ func (conn *LocalConnection) gossipSenders() *gossipSenders {
 // do not need locks for reading, and only need write locks for fields
 // read by other processes.
 
+// gossipCodec implements gossipCodecConnection.
+func (conn *LocalConnection) gossipCodec() gossipCodec {
+	return conn.codec
+}
+
+func (conn *LocalConnection) exchangesDigests() bool {
+	return conn.digests
+}
+
+func (conn *LocalConnection) answersQueries() bool {
+	return conn.queries
+}
+
 // Non-blocking.
 func (conn *LocalConnection) shutdown(err error) {
 	// err should always be a real error, even if only io.EOF
@@ -159,20 +223,28 @@ func (conn *LocalConnection) shutdown(err error) {
 
 func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{}, acceptNewPeer bool) {
 	var err error // important to use this var and not create another one with 'err :='
+	defer conn.router.removeLocalConnection(conn)
+	defer conn.senders.wait()
 	defer func() { conn.teardown(err) }()
 	defer close(finished)
 
-	if err = conn.tcpConn.SetLinger(0); err != nil {
-		return
+	if tcpConn, ok := conn.netConn.(*net.TCPConn); ok {
+		if err = tcpConn.SetLinger(0); err != nil {
+			return
+		}
 	}
 
+	password, acceptPasswords := conn.router.getPasswords()
 	intro, err := protocolIntroParams{
-		MinVersion: conn.router.ProtocolMinVersion,
-		MaxVersion: ProtocolMaxVersion,
-		Features:   conn.makeFeatures(),
-		Conn:       conn.tcpConn,
-		Password:   conn.router.Password,
-		Outbound:   conn.outbound,
+		MinVersion:      conn.router.ProtocolMinVersion,
+		MaxVersion:      ProtocolMaxVersion,
+		Features:        conn.makeFeatures(),
+		Conn:            conn.netConn,
+		Password:        password,
+		AcceptPasswords: acceptPasswords,
+		Identity:        conn.router.Identity,
+		CheckIdentity:   conn.router.AllowedPeers != nil,
+		Outbound:        conn.outbound,
 	}.doIntro()
 	if err != nil {
 		return
@@ -181,16 +253,42 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	conn.sessionKey = intro.SessionKey
 	conn.tcpSender = intro.Sender
 	conn.version = intro.Version
+	conn.identityKey = intro.IdentityKey
+	conn.passwordIndex = -1
+	if password != nil {
+		conn.passwordIndex = intro.PasswordIndex
+	}
+	conn.cryptoSender, _ = intro.Sender.(*encryptedTCPSender)
+	conn.cryptoReceiver, _ = intro.Receiver.(*encryptedTCPReceiver)
+	_, conn.rekeying = intro.Features["Rekey"]
+	conn.rekeying = conn.rekeying && conn.cryptoReceiver != nil
+	conn.compressing = conn.router.compressionThreshold() > 0 && supportsDeflate(intro.Features["Compression"])
+	if err = conn.setMaxMessageSize(intro.Features); err != nil {
+		return
+	}
+	_, conn.digests = intro.Features["Digests"]
+	_, conn.queries = intro.Features["Queries"]
+	_, conn.echoes = intro.Features["HeartbeatEcho"]
+	conn.codec = gossipCodecForVersion(conn.version)
+	if _, interning := intro.Features["ChannelIDs"]; interning && conn.version >= 3 {
+		// SendProtocolMsg writes to the connection before returning, so
+		// the announcement of a channel ID precedes any msg using it.
+		conn.codec = newInternedGossipCodec(conn.SendProtocolMsg)
+	}
 
 	remote, err := conn.parseFeatures(intro.Features)
 	if err != nil {
 		return
 	}
 
-	if err = conn.registerRemote(remote, acceptNewPeer); err != nil {
+	if err = conn.checkAllowed(remote.Name); err != nil {
+		return
+	}
+
+	isRestartedPeer, err := conn.registerRemote(remote, acceptNewPeer)
+	if err != nil {
 		return
 	}
-	isRestartedPeer := conn.Remote().UID != remote.UID
 
 	conn.logf("connection ready; using protocol version %v", conn.version)
 
@@ -202,8 +300,8 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 
 	params := OverlayConnectionParams{
 		RemotePeer:         conn.remote,
-		LocalAddr:          conn.tcpConn.LocalAddr().(*net.TCPAddr),
-		RemoteAddr:         conn.tcpConn.RemoteAddr().(*net.TCPAddr),
+		LocalAddr:          tcpAddr(conn.netConn.LocalAddr()),
+		RemoteAddr:         tcpAddr(conn.netConn.RemoteAddr()),
 		Outbound:           conn.outbound,
 		ConnUID:            conn.uid,
 		SessionKey:         sessionKey,
@@ -244,6 +342,11 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	// references to peers. Hence we must invoke AddConnection,
 	// which is *synchronous*, first.
 	conn.heartbeatTCP = time.NewTicker(tcpHeartbeat)
+	if conn.router.PhiThreshold > 0 {
+		conn.phiCheck = time.NewTicker(phiCheckInterval)
+	}
+	conn.rekeyChan = make(chan func() error, 2)
+	conn.echoChan = make(chan []byte, 1)
 	go conn.receiveTCP(intro.Receiver)
 
 	// AddConnection must precede actorLoop. More precisely, it
@@ -265,6 +368,15 @@ func (conn *LocalConnection) makeFeatures() map[string]string {
 		"UID":             fmt.Sprint(conn.local.UID),
 		"ConnID":          fmt.Sprint(conn.uid),
 		"Trusted":         fmt.Sprint(conn.trustRemote),
+		"Rekey":           "1",
+		"ChannelIDs":      "1",
+		"Digests":         "1",
+		"Queries":         "1",
+		"HeartbeatEcho":   "1",
+		"Chunking":        fmt.Sprint(conn.router.maxMessageSize()),
+	}
+	if conn.router.compressionThreshold() > 0 {
+		features["Compression"] = compressionDeflate
 	}
 	conn.router.Overlay.AddFeaturesTo(features)
 	return features
@@ -284,6 +396,9 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 	if err != nil {
 		return nil, err
 	}
+	if err := checkCertifiedName(conn.netConn, name); err != nil {
+		return nil, err
+	}
 
 	nickName := features["NickName"]
 
@@ -322,29 +437,54 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 	return peer, nil
 }
 
-func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) error {
+// checkAllowed consults the router's AllowedPeers, if any, about the
+// remote's proven identity.
+func (conn *LocalConnection) checkAllowed(name PeerName) error {
+	allowed := conn.router.AllowedPeers
+	switch {
+	case allowed == nil:
+		return nil
+	case conn.identityKey == nil:
+		return fmt.Errorf("peer %s did not prove an identity", name)
+	case !allowed(name, conn.identityKey):
+		return fmt.Errorf("peer %s identity %x is not allowed", name, []byte(conn.identityKey))
+	}
+	return nil
+}
+
+// registerRemote returns whether the remote is a restarted peer, i.e. one
+// we knew by another UID.
+func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) (bool, error) {
+	peers := conn.router.Peers
 	if acceptNewPeer {
-		conn.remote = conn.router.Peers.fetchWithDefault(remote)
+		conn.remote = peers.fetchWithDefault(remote)
 	} else {
-		conn.remote = conn.router.Peers.fetchAndAddRef(remote.Name)
+		conn.remote = peers.fetchAndAddRef(remote.Name)
 		if conn.remote == nil {
-			return fmt.Errorf("Found unknown remote name: %s at %s", remote.Name, conn.remoteTCPAddr)
+			return false, fmt.Errorf("Found unknown remote name: %s at %s", remote.Name, conn.remoteTCPAddr)
 		}
 	}
 
 	if remote.Name == conn.local.Name && remote.UID != conn.local.UID {
-		return &peerNameCollisionError{conn.local, remote}
+		return false, &peerNameCollisionError{conn.local, remote}
 	}
 	if conn.remote == conn.local {
-		return errConnectToSelf
+		return false, errConnectToSelf
 	}
 
-	return nil
+	// Topology updates change the UID under the lock on Peers.
+	peers.RLock()
+	defer peers.RUnlock()
+	return conn.remote.UID != remote.UID, nil
 }
 
 func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 	fwdErrorChan := conn.OverlayConn.ErrorChannel()
 	fwdEstablishedChan := conn.OverlayConn.EstablishedChannel()
+	var phiCheck <-chan time.Time
+	if conn.phiCheck != nil {
+		phiCheck = conn.phiCheck.C
+	}
 
 	for err == nil {
 		select {
@@ -353,11 +493,21 @@ func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 		default:
 			select {
 			case <-conn.heartbeatTCP.C:
-				err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
+				if err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat); err == nil {
+					err = conn.sendEchoRequest()
+				}
+			case payload := <-conn.echoChan:
+				err = conn.sendProtocolMsg(protocolMsg{ProtocolHeartbeatEcho, payload})
+			case now := <-phiCheck:
+				err = conn.checkHeartbeats(now)
+			case rekey := <-conn.rekeyChan:
+				err = rekey()
 			case <-fwdEstablishedChan:
-				conn.established = true
+				atomic.StoreInt32(&conn.established, 1)
 				fwdEstablishedChan = nil
 				conn.router.Ourself.doConnectionEstablished(conn)
+				// Measure the RTT now, rather than at the first heartbeat.
+				err = conn.sendEchoRequest()
 			case err = <-errorChan:
 			case err = <-fwdErrorChan:
 			}
@@ -374,8 +524,16 @@ func (conn *LocalConnection) teardown(err error) {
 		conn.logf("connection shutting down due to error: %v", err)
 	}
 
-	if conn.tcpConn != nil {
-		if closeErr := conn.tcpConn.Close(); closeErr != nil {
+	if err == errRouterStopped && conn.tcpSender != nil {
+		// Let the remote know straight away, rather than have it
+		// wait for the connection to fail.
+		if goodbyeErr := conn.sendSimpleProtocolMsg(ProtocolGoodbye); goodbyeErr != nil {
+			conn.logf("unable to say goodbye: %v", goodbyeErr)
+		}
+	}
+
+	if conn.netConn != nil {
+		if closeErr := conn.netConn.Close(); closeErr != nil {
 			log.Info("warning: %v", closeErr)
 		}
 	}
@@ -388,6 +546,9 @@ func (conn *LocalConnection) teardown(err error) {
 	if conn.heartbeatTCP != nil {
 		conn.heartbeatTCP.Stop()
 	}
+	if conn.phiCheck != nil {
+		conn.phiCheck.Stop()
+	}
 
 	if conn.OverlayConn != nil {
 		conn.OverlayConn.Stop()
@@ -407,7 +568,79 @@ func (conn *LocalConnection) sendSimpleProtocolMsg(tag protocolTag) error {
 }
 
 func (conn *LocalConnection) sendProtocolMsg(m protocolMsg) error {
-	return conn.tcpSender.Send(append([]byte{byte(m.tag)}, m.msg...))
+	return conn.sendProtocolMsgInTurns(m, nil)
+}
+
+// sendProtocolMsgInTurns is sendProtocolMsg, taking a turn from turns, if
+// any, for each frame.
+func (conn *LocalConnection) sendProtocolMsgInTurns(m protocolMsg, turns *gossipTurns) error {
+	msg := append([]byte{byte(m.tag)}, m.msg...)
+	size := len(msg)
+	if size > conn.maxMessageSize {
+		return &messageTooLargeError{size, conn.maxMessageSize}
+	}
+	if conn.compressing && size >= conn.router.compressionThreshold() {
+		if deflated := deflate([]byte{ProtocolCompressed}, msg); deflated != nil {
+			msg = deflated
+		}
+	}
+	conn.compression.add(size, len(msg))
+	if conn.chunking && len(msg) > chunkSize {
+		return conn.sendChunked(msg, turns)
+	}
+	return turns.send(func() error { return conn.tcpSender.Send(msg) })
+}
+
+// setMaxMessageSize works out the largest msg we can send, given the
+// remote's features, and the largest we accept.
+func (conn *LocalConnection) setMaxMessageSize(features map[string]string) error {
+	ourMax := conn.router.maxMessageSize()
+	conn.reassembler.maxSize = ourMax
+	conn.maxMessageSize = maxUnchunkedMsgSize
+	if maxStr, ok := features["Chunking"]; ok {
+		theirMax, err := strconv.Atoi(maxStr)
+		if err != nil {
+			return err
+		}
+		if theirMax < maxUnchunkedMsgSize {
+			return fmt.Errorf("remote maximum message size %d is less than a single frame (%d)", theirMax, maxUnchunkedMsgSize)
+		}
+		conn.chunking = true
+		conn.maxMessageSize = theirMax
+	}
+	if ourMax < conn.maxMessageSize {
+		conn.maxMessageSize = ourMax
+	}
+	return nil
+}
+
+// sendChunked sends msg as a series of ProtocolChunk msgs. Each is sent
+// separately, in a turn of its own from turns, if any, so that other msgs
+// can be sent in between, but chunked msgs are sent one at a time, so as
+// to stay within what the remote is willing to reassemble.
+func (conn *LocalConnection) sendChunked(msg []byte, turns *gossipTurns) error {
+	conn.chunkLock.Lock()
+	defer conn.chunkLock.Unlock()
+	header := chunkHeader(atomic.AddUint64(&conn.chunkID, 1), len(msg))
+	for first := true; len(msg) > 0; first = false {
+		n := chunkSize
+		if n > len(msg) {
+			n = len(msg)
+		}
+		chunk := append(header, msg[:n]...)
+		send := func() error { return conn.tcpSender.Send(chunk) }
+		err := turns.send(send)
+		if err == errNoTurn && !first {
+			// Finish the msg regardless, lest the remote hold on
+			// to its chunks.
+			err = send()
+		}
+		if err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
 }
 
 func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
@@ -420,6 +653,7 @@ func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 		if msg, err = receiver.Receive(); err != nil {
 			break
 		}
+		conn.heartbeats.arrival(time.Now())
 		if len(msg) < 1 {
 			conn.logf("ignoring blank msg")
 			continue
@@ -427,17 +661,105 @@ func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 		if err = conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:]); err != nil {
 			break
 		}
+		if err = conn.maybeRekey(); err != nil {
+			break
+		}
 	}
 	conn.shutdown(err)
 }
 
+// maybeRekey asks the remote to replace the session key it encrypts with,
+// once that has been used for long enough. Must only be called from the
+// receiveTCP goroutine.
+func (conn *LocalConnection) maybeRekey() error {
+	if !conn.rekeying || !conn.cryptoReceiver.rekeyDue(conn.router.rekeyMessages(), conn.router.rekeyInterval(), time.Now()) {
+		return nil
+	}
+	pubKey, err := conn.cryptoReceiver.beginRekey()
+	if err != nil {
+		return err
+	}
+	return conn.queueRekey(func() error {
+		return conn.sendProtocolMsg(protocolMsg{ProtocolRekey, pubKey})
+	})
+}
+
+// queueRekey has the actor perform a rekeying send. Each side has at most
+// one rekey of its own in progress, and answers at most one of the
+// remote's, so rekeyChan only fills up if the remote misbehaves.
+func (conn *LocalConnection) queueRekey(f func() error) error {
+	select {
+	case conn.rekeyChan <- f:
+		return nil
+	default:
+		return errTooManyRekeys
+	}
+}
+
+// rekeyCounts returns how many times the session keys of what we send and
+// receive have been replaced.
+func (conn *LocalConnection) rekeyCounts() (send, receive uint64) {
+	if conn.cryptoSender != nil {
+		send = conn.cryptoSender.rekeyCount()
+	}
+	if conn.cryptoReceiver != nil {
+		receive = conn.cryptoReceiver.rekeyCount()
+	}
+	return
+}
+
 func (conn *LocalConnection) handleProtocolMsg(tag protocolTag, payload []byte) error {
 	switch tag {
 	case ProtocolHeartbeat:
+		conn.heartbeats.heartbeat(time.Now())
+	case ProtocolHeartbeatEcho:
+		return conn.handleHeartbeatEcho(payload)
 	case ProtocolReserved1, ProtocolReserved2, ProtocolReserved3, ProtocolOverlayControlMsg:
 		conn.OverlayConn.ControlMessage(byte(tag), payload)
-	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip:
-		return conn.router.handleGossip(tag, payload)
+	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip, ProtocolGossipQuery, ProtocolGossipQueryReply, ProtocolGossipDigest:
+		return conn.router.handleGossip(conn.gossipCodec(), tag, payload)
+	case ProtocolGoodbye:
+		return errRemoteGoodbye
+	case ProtocolRekey:
+		if conn.cryptoSender == nil {
+			return errRekeyUnencrypted
+		}
+		// Sending from here could deadlock with the remote doing
+		// likewise, so leave it to the actor.
+		return conn.queueRekey(func() error {
+			return conn.cryptoSender.rekey(payload, func(pubKey []byte) []byte {
+				return append([]byte{ProtocolRekeyAck}, pubKey...)
+			})
+		})
+	case ProtocolCompressed:
+		msg, err := conn.inflater.inflate(payload, conn.router.maxMessageSize())
+		if err != nil {
+			return err
+		}
+		if len(msg) < 1 || msg[0] == ProtocolCompressed || msg[0] == ProtocolChunk {
+			return fmt.Errorf("malformed compressed msg")
+		}
+		return conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:])
+	case ProtocolChunk:
+		msg, err := conn.reassembler.add(payload)
+		if err != nil || msg == nil {
+			return err
+		}
+		if msg[0] == ProtocolChunk {
+			return errMalformedChunk
+		}
+		return conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:])
+	case ProtocolChannelID:
+		codec, ok := conn.codec.(*internedGossipCodec)
+		if !ok {
+			return fmt.Errorf("unexpected gossip channel ID announcement")
+		}
+		return codec.learn(payload)
+	case ProtocolRekeyAck:
+		if conn.cryptoReceiver == nil {
+			return errRekeyUnencrypted
+		}
+		return conn.cryptoReceiver.completeRekey(payload)
 	default:
 		conn.logf("ignoring unknown protocol tag: %v", tag)
 	}
@@ -445,7 +767,7 @@ func (conn *LocalConnection) handleProtocolMsg(tag protocolTag, payload []byte)
 }
 
 func (conn *LocalConnection) extendReadDeadline() error {
-	return conn.tcpConn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2))
+	return conn.netConn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2))
 }
 
 // Untrusted returns true if either we don't trust our remote, or are not
@@ -462,7 +784,12 @@ const (
 	tieBreakTied
 )
 
-var errConnectToSelf = fmt.Errorf("cannot connect to ourself")
+var (
+	errConnectToSelf    = fmt.Errorf("cannot connect to ourself")
+	errRemoteGoodbye    = fmt.Errorf("remote peer said goodbye")
+	errRekeyUnencrypted = fmt.Errorf("remote asked to rekey an unencrypted connection")
+	errTooManyRekeys    = fmt.Errorf("remote sent too many rekey requests")
+)
 
 type peerNameCollisionError struct {
 	local, remote *Peer
@@ -472,6 +799,12 @@ func (err *peerNameCollisionError) Error() string {
 	return fmt.Sprintf("local %q and remote %q peer names collision", err.local, err.remote)
 }
 
+// tcpAddr returns addr if it is a TCP address, and nil otherwise.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	tcpAddr, _ := addr.(*net.TCPAddr)
+	return tcpAddr
+}
+
 func mustHave(features map[string]string, keys []string) error {
 	for _, key := range keys {
 		if _, ok := features[key]; !ok {
@@ -30,6 +30,8 @@ type connectionMaker struct {
 	directPeers      peerAddrs
 	terminationCount int
 	actionChan       chan<- connectionMakerAction
+	quit             chan struct{}
+	finished         chan struct{} // closed to signal that queryLoop has finished
 }
 
 // TargetState describes the connection state of a remote target.
@@ -71,6 +73,8 @@ func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port
 		targets:     make(map[string]*target),
 		connections: make(map[Connection]struct{}),
 		actionChan:  actionChan,
+		quit:        make(chan struct{}),
+		finished:    make(chan struct{}),
 	}
 	go cm.queryLoop(actionChan)
 	return cm
@@ -212,6 +216,15 @@ func (cm *connectionMaker) connectionTerminated(conn Connection, err error) {
 	}
 }
 
+// setPort changes the port we listen on, which is also the port we assume
+// peers listen on when none is given.
+func (cm *connectionMaker) setPort(port int) {
+	cm.actionChan <- func() bool {
+		cm.port = port
+		return true
+	}
+}
+
 // refresh sends a no-op action into the ConnectionMaker, purely so that the
 // ConnectionMaker will check the state of its targets and reconnect to
 // relevant candidates.
@@ -219,8 +232,17 @@ func (cm *connectionMaker) refresh() {
 	cm.actionChan <- func() bool { return true }
 }
 
+// stop terminates the actor and waits for it to finish. The caller must
+// ensure that no connections or connection attempts are outstanding.
+func (cm *connectionMaker) stop() {
+	close(cm.quit)
+	<-cm.finished
+}
+
 func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
+	defer close(cm.finished)
 	timer := time.NewTimer(maxDuration)
+	defer timer.Stop()
 	run := func() { timer.Reset(cm.checkStateAndAttemptConnections()) }
 	for {
 		select {
@@ -230,6 +252,8 @@ func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
 			}
 		case <-timer.C:
 			run()
+		case <-cm.quit:
+			return
 		}
 	}
 }
@@ -360,6 +384,10 @@ func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, dir
 		target.state = targetWaiting
 		switch duration := target.tryAfter.Sub(now); {
 		case duration <= 0:
+			if !cm.ourself.router.track() {
+				// The router is stopping; leave the target be.
+				continue
+			}
 			target.state = targetAttempting
 			_, isCmdLineTarget := directTarget[address]
 			go cm.attemptConnection(address, isCmdLineTarget)
@@ -371,6 +399,7 @@ func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, dir
 }
 
 func (cm *connectionMaker) attemptConnection(address string, acceptNewPeer bool) {
+	defer cm.ourself.router.untrack()
 	log.Debug("->[%s] attempting connection", address)
 	if err := cm.ourself.createConnection(cm.localAddr, address, acceptNewPeer); err != nil {
 		log.Debug("->[%s] error during connection attempt: %v", address, err)
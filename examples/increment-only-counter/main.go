@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/branthz/mesh"
 	"github.com/branthz/utarrow/lib/log"
@@ -75,11 +77,15 @@ func main() {
 
 	func() {
 		log.Info("mesh router starting (%s)", *meshListen)
-		router.Start()
+		if err := router.Start(); err != nil {
+			log.Fatal("Could not start router: %v", err)
+		}
 	}()
 	defer func() {
 		log.Info("mesh router stopping")
-		router.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		router.Stop(ctx)
 	}()
 
 	router.ConnectionMaker.InitiateConnections(peers.slice(), true)
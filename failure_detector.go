@@ -0,0 +1,640 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/branthz/utarrow/lib/log"
+)
+
+const (
+	failureDetectorChannel = "failure-detector"
+	defaultProbeInterval   = time.Second
+	defaultIndirectProbes  = 3
+	defaultSuspicionProbes = 5 // ProbeIntervals a peer stays suspect by default
+	maxQueuedAcks          = 64
+	maxProbesFor           = 16 // concurrent probes on behalf of others
+)
+
+// MemberState is the liveness of a peer, as judged by a FailureDetector.
+type MemberState int
+
+const (
+	// MemberAlive is a peer which answers probes, or has refuted
+	// suspicion.
+	MemberAlive MemberState = iota
+	// MemberSuspect is a peer which failed to answer a probe, and has yet
+	// to refute it.
+	MemberSuspect
+	// MemberDead is a peer which stayed suspect for SuspicionTimeout.
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// FailureDetectorConfig configures a FailureDetector. Zero values select
+// the defaults.
+type FailureDetectorConfig struct {
+	// ProbeInterval is how often we probe a peer; peers are probed in
+	// turn. Default 1s.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long we wait for a peer to ack a probe before
+	// asking others to probe it. It must be less than ProbeInterval,
+	// which bounds the wait for their acks. Default half ProbeInterval.
+	ProbeTimeout time.Duration
+	// IndirectProbes is how many peers we ask to probe a peer which fails
+	// to ack. Default 3.
+	IndirectProbes int
+	// SuspicionTimeout is how long a peer stays suspect before being
+	// declared dead, unless it refutes the suspicion. Default 5
+	// ProbeIntervals.
+	SuspicionTimeout time.Duration
+}
+
+// MemberStatus is the liveness of a peer.
+type MemberStatus struct {
+	Name        PeerName
+	Incarnation uint64
+	State       MemberState
+}
+
+// FailureDetector judges the liveness of the peers in the mesh, in the
+// manner of SWIM, on its own gossip channel. Each ProbeInterval it pings
+// the next peer in a shuffled round of those not dead. A peer which fails
+// to ack within ProbeTimeout is pinged through IndirectProbes others, and
+// one which fails to ack through them either by the end of the interval
+// becomes suspect. A peer suspect for SuspicionTimeout becomes dead.
+//
+// Judgements are broadcast, and gossiped periodically, as the state and
+// incarnation of each peer. Of two judgements of a peer, that of the
+// higher incarnation wins, or else the more severe. A peer which learns
+// it is suspected, or declared dead, refutes it by broadcasting that it
+// is alive in a higher incarnation, so a restarted peer recovers once it
+// has heard its old incarnation was declared dead.
+//
+// Every peer in the mesh should run a FailureDetector, since those which
+// do not never ack, and so are declared dead.
+type FailureDetector struct {
+	router *Router
+	config FailureDetectorConfig
+
+	sync.Mutex
+	gossip  Gossip
+	self    memberEntry
+	members map[PeerName]*member
+	acks    map[uint64]*pendingAck // by probe seq
+	round   []PeerName             // yet to be probed this round
+
+	replies   chan swimReply // acks to send, by ackLoop
+	probesFor chan struct{}  // a token per probe on behalf of others
+}
+
+// pendingAck is a probe awaiting an ack from any of the peers asked.
+type pendingAck struct {
+	acked chan struct{} // closed on ack
+	from  []PeerName    // the target, and any helpers asked
+}
+
+type swimReply struct {
+	dst PeerName
+	seq uint64
+}
+
+type member struct {
+	memberEntry
+	suspected time.Time // when it became suspect
+}
+
+type memberEntry struct {
+	Incarnation uint64
+	State       MemberState
+}
+
+// supersedes reports whether e is a later judgement than other.
+func (e memberEntry) supersedes(other memberEntry) bool {
+	return e.Incarnation > other.Incarnation || (e.Incarnation == other.Incarnation && e.State > other.State)
+}
+
+// A failure detector unicast is a kind byte followed by the uvarint seq of
+// the probe, and for a ping request, the name bytes of the peer to ping.
+const (
+	swimPing byte = iota
+	swimPingRequest
+	swimAck
+)
+
+var errProbeTimeout = fmt.Errorf("probe timeout must be less than probe interval")
+
+// NewFailureDetector starts a FailureDetector, which runs until the router
+// is stopped. There can be only one per router.
+func (router *Router) NewFailureDetector(config FailureDetectorConfig) (*FailureDetector, error) {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = defaultProbeInterval
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = config.ProbeInterval / 2
+	}
+	if config.ProbeTimeout >= config.ProbeInterval {
+		return nil, errProbeTimeout
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = defaultIndirectProbes
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = defaultSuspicionProbes * config.ProbeInterval
+	}
+	fd := &FailureDetector{
+		router:    router,
+		config:    config,
+		members:   make(map[PeerName]*member),
+		acks:      make(map[uint64]*pendingAck),
+		replies:   make(chan swimReply, maxQueuedAcks),
+		probesFor: make(chan struct{}, maxProbesFor),
+	}
+	// Tracked before registering the channel, so that there is no
+	// channel without its loops should the router be stopping.
+	if !router.trackN(2) {
+		return nil, errRouterStopped
+	}
+	gossip, err := router.NewGossipWithConfig(failureDetectorChannel, fd, GossipConfig{Priority: GossipPriorityHigh})
+	if err != nil {
+		router.untrack()
+		router.untrack()
+		return nil, err
+	}
+	fd.Lock()
+	fd.gossip = gossip
+	fd.Unlock()
+	go fd.probeLoop()
+	go fd.ackLoop()
+	return fd, nil
+}
+
+// State returns the state of the named peer. Peers yet to be judged are
+// alive.
+func (fd *FailureDetector) State(name PeerName) MemberState {
+	fd.Lock()
+	defer fd.Unlock()
+	if m, found := fd.members[name]; found {
+		return m.State
+	}
+	return MemberAlive
+}
+
+// Members returns the status of every peer known to the router, ourself
+// included, ordered by name.
+func (fd *FailureDetector) Members() []MemberStatus {
+	names := fd.router.Peers.names()
+	fd.Lock()
+	defer fd.Unlock()
+	statuses := make([]MemberStatus, 0, len(names))
+	for name := range names {
+		status := MemberStatus{Name: name}
+		if name == fd.router.Ourself.Name {
+			status.Incarnation, status.State = fd.self.Incarnation, fd.self.State
+		} else if m, found := fd.members[name]; found {
+			status.Incarnation, status.State = m.Incarnation, m.State
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (fd *FailureDetector) probeLoop() {
+	defer fd.router.untrack()
+	ticker := time.NewTicker(fd.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fd.router.quit:
+			return
+		}
+		fd.expireSuspicions()
+		if target, found := fd.nextTarget(); found && !fd.probe(target) {
+			fd.suspect(target)
+		}
+	}
+}
+
+// ackLoop sends the acks queued by OnGossipUnicast. It is not run on the
+// connection's receiving goroutine, lest that block sending while its
+// counterpart at the pinging peer does likewise.
+func (fd *FailureDetector) ackLoop() {
+	defer fd.router.untrack()
+	for {
+		select {
+		case reply := <-fd.replies:
+			fd.unicast(reply.dst, makeSWIMMsg(swimAck, reply.seq))
+		case <-fd.router.quit:
+			return
+		}
+	}
+}
+
+// nextTarget returns the next peer to probe, starting a new round once
+// all have been probed. Starting a round forgets peers no longer known
+// to the router.
+func (fd *FailureDetector) nextTarget() (PeerName, bool) {
+	names := fd.router.Peers.names()
+	fd.Lock()
+	defer fd.Unlock()
+	if len(fd.round) == 0 {
+		for name := range fd.members {
+			if _, found := names[name]; !found {
+				delete(fd.members, name)
+			}
+		}
+		for name := range names {
+			if name != fd.router.Ourself.Name {
+				fd.round = append(fd.round, name)
+			}
+		}
+		rand.Shuffle(len(fd.round), func(i, j int) { fd.round[i], fd.round[j] = fd.round[j], fd.round[i] })
+	}
+	for len(fd.round) > 0 {
+		name := fd.round[0]
+		fd.round = fd.round[1:]
+		if _, found := names[name]; !found {
+			continue
+		}
+		if m, found := fd.members[name]; !found || m.State != MemberDead {
+			return name, true
+		}
+	}
+	return UnknownPeerName, false
+}
+
+// probe pings target, directly and then indirectly, reporting whether it
+// acked.
+func (fd *FailureDetector) probe(target PeerName) bool {
+	seq, acked := fd.expectAck(target)
+	defer fd.forgetAck(seq)
+	fd.unicast(target, makeSWIMMsg(swimPing, seq))
+	timer := time.NewTimer(fd.config.ProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+	case <-fd.router.quit:
+		return true
+	}
+
+	helpers := fd.helpers(target)
+	fd.expectAckFrom(seq, helpers)
+	request := append(makeSWIMMsg(swimPingRequest, seq), target.bytes()...)
+	for _, helper := range helpers {
+		fd.unicast(helper, request)
+	}
+	timer.Reset(fd.config.ProbeInterval - fd.config.ProbeTimeout)
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+		return false
+	case <-fd.router.quit:
+		return true
+	}
+}
+
+// helpers returns up to IndirectProbes random peers, other than target,
+// to ask to probe it.
+func (fd *FailureDetector) helpers(target PeerName) []PeerName {
+	names := fd.router.Peers.names()
+	fd.Lock()
+	defer fd.Unlock()
+	var helpers []PeerName
+	for name := range names {
+		if name == target || name == fd.router.Ourself.Name {
+			continue
+		}
+		if m, found := fd.members[name]; found && m.State != MemberAlive {
+			continue
+		}
+		helpers = append(helpers, name)
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > fd.config.IndirectProbes {
+		helpers = helpers[:fd.config.IndirectProbes]
+	}
+	return helpers
+}
+
+// probeFor pings target on behalf of src, passing on its ack.
+func (fd *FailureDetector) probeFor(src PeerName, srcSeq uint64, target PeerName) {
+	defer fd.router.untrack()
+	defer func() { <-fd.probesFor }()
+	seq, acked := fd.expectAck(target)
+	defer fd.forgetAck(seq)
+	fd.unicast(target, makeSWIMMsg(swimPing, seq))
+	timer := time.NewTimer(fd.config.ProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+		fd.unicast(src, makeSWIMMsg(swimAck, srcSeq))
+	case <-timer.C:
+	case <-fd.router.quit:
+	}
+}
+
+// expectAck registers a probe of target, returning its seq, and a chan
+// closed on its ack. Seqs are random, so that they cannot be guessed by
+// peers other than those asked.
+func (fd *FailureDetector) expectAck(target PeerName) (uint64, <-chan struct{}) {
+	fd.Lock()
+	defer fd.Unlock()
+	seq := randUint64()
+	for _, found := fd.acks[seq]; found; _, found = fd.acks[seq] {
+		seq = randUint64()
+	}
+	pending := &pendingAck{acked: make(chan struct{}), from: []PeerName{target}}
+	fd.acks[seq] = pending
+	return seq, pending.acked
+}
+
+// expectAckFrom accepts acks of the probe seq from helpers as well.
+func (fd *FailureDetector) expectAckFrom(seq uint64, helpers []PeerName) {
+	fd.Lock()
+	defer fd.Unlock()
+	if pending, found := fd.acks[seq]; found {
+		pending.from = append(pending.from, helpers...)
+	}
+}
+
+// ack closes the chan of the probe seq, if src was asked to ack it.
+func (fd *FailureDetector) ack(src PeerName, seq uint64) {
+	fd.Lock()
+	defer fd.Unlock()
+	pending, found := fd.acks[seq]
+	if !found {
+		return
+	}
+	for _, name := range pending.from {
+		if name == src {
+			delete(fd.acks, seq)
+			close(pending.acked)
+			return
+		}
+	}
+}
+
+func (fd *FailureDetector) forgetAck(seq uint64) {
+	fd.Lock()
+	defer fd.Unlock()
+	delete(fd.acks, seq)
+}
+
+// suspect judges target suspect, unless it already is, or is dead.
+func (fd *FailureDetector) suspect(target PeerName) {
+	fd.Lock()
+	entry := memberEntry{State: MemberSuspect}
+	if m, found := fd.members[target]; found {
+		entry.Incarnation = m.Incarnation
+	}
+	applied := fd.apply(target, entry)
+	fd.Unlock()
+	if applied {
+		log.Info("[gossip %s]: peer %s is suspect", failureDetectorChannel, target)
+		fd.broadcast(memberUpdates{target: entry})
+	}
+}
+
+// expireSuspicions judges peers suspect for SuspicionTimeout dead.
+func (fd *FailureDetector) expireSuspicions() {
+	now := time.Now()
+	dead := make(memberUpdates)
+	fd.Lock()
+	for name, m := range fd.members {
+		if m.State == MemberSuspect && now.Sub(m.suspected) >= fd.config.SuspicionTimeout {
+			m.State = MemberDead
+			dead[name] = m.memberEntry
+		}
+	}
+	fd.Unlock()
+	if len(dead) > 0 {
+		for name := range dead {
+			log.Info("[gossip %s]: peer %s is dead", failureDetectorChannel, name)
+		}
+		fd.broadcast(dead)
+	}
+}
+
+// apply adopts entry as the judgement of the named peer if it supersedes
+// ours, reporting whether it did. A judgement of ourself that we are not
+// alive is refuted instead. Must hold the lock.
+func (fd *FailureDetector) apply(name PeerName, entry memberEntry) bool {
+	if name == fd.router.Ourself.Name {
+		switch {
+		case entry.State != MemberAlive && entry.Incarnation >= fd.self.Incarnation:
+			fd.self.Incarnation = entry.Incarnation + 1
+			return true
+		case entry.Incarnation > fd.self.Incarnation:
+			// We were alive in a later incarnation before restarting.
+			fd.self.Incarnation = entry.Incarnation
+		}
+		return false
+	}
+	m, found := fd.members[name]
+	if !found {
+		m = &member{}
+	}
+	if !entry.supersedes(m.memberEntry) {
+		return false
+	}
+	if entry.State == MemberSuspect {
+		m.suspected = time.Now()
+	}
+	m.memberEntry = entry
+	fd.members[name] = m
+	return true
+}
+
+// merge applies updates, returning those applied, and broadcasting any
+// refutation.
+func (fd *FailureDetector) merge(updates memberUpdates) GossipData {
+	delta := make(memberUpdates)
+	fd.Lock()
+	refuted := false
+	for name, entry := range updates {
+		if fd.apply(name, entry) {
+			if name == fd.router.Ourself.Name {
+				refuted = true
+				continue
+			}
+			delta[name] = entry
+		}
+	}
+	self := fd.self
+	fd.Unlock()
+	if refuted {
+		fd.broadcast(memberUpdates{fd.router.Ourself.Name: self})
+	}
+	if len(delta) == 0 {
+		return nil
+	}
+	return delta
+}
+
+func (fd *FailureDetector) broadcast(updates memberUpdates) {
+	fd.Lock()
+	gossip := fd.gossip
+	fd.Unlock()
+	if gossip != nil {
+		gossip.GossipBroadcast(updates)
+	}
+}
+
+func (fd *FailureDetector) unicast(dst PeerName, msg []byte) {
+	fd.Lock()
+	gossip := fd.gossip
+	fd.Unlock()
+	if gossip != nil {
+		// A failed unicast is an unacked probe.
+		gossip.GossipUnicast(dst, msg)
+	}
+}
+
+// OnGossipUnicast implements Gossiper, handling pings and acks.
+func (fd *FailureDetector) OnGossipUnicast(src PeerName, msg []byte) error {
+	if len(msg) < 1 {
+		return errMalformedGossip
+	}
+	nums, rest, err := readUvarints(msg[1:], 1)
+	if err != nil {
+		return err
+	}
+	seq := nums[0]
+	switch msg[0] {
+	case swimPing:
+		// When the queue is full the ack is dropped, which the pinging
+		// peer makes up for by probing us indirectly.
+		select {
+		case fd.replies <- swimReply{dst: src, seq: seq}:
+		default:
+		}
+	case swimPingRequest:
+		select {
+		case fd.probesFor <- struct{}{}:
+		default:
+			return nil
+		}
+		if !fd.router.track() {
+			<-fd.probesFor
+			return nil
+		}
+		go fd.probeFor(src, seq, PeerNameFromBin(rest))
+	case swimAck:
+		fd.ack(src, seq)
+	default:
+		return errMalformedGossip
+	}
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper.
+func (fd *FailureDetector) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	updates, err := decodeMemberUpdates(update)
+	if err != nil {
+		return nil, err
+	}
+	return fd.merge(updates), nil
+}
+
+// Gossip implements Gossiper, returning every judgement, ourself included.
+func (fd *FailureDetector) Gossip() GossipData {
+	fd.Lock()
+	defer fd.Unlock()
+	updates := memberUpdates{fd.router.Ourself.Name: fd.self}
+	for name, m := range fd.members {
+		updates[name] = m.memberEntry
+	}
+	return updates
+}
+
+// OnGossip implements Gossiper.
+func (fd *FailureDetector) OnGossip(msg []byte) (GossipData, error) {
+	updates, err := decodeMemberUpdates(msg)
+	if err != nil {
+		return nil, err
+	}
+	return fd.merge(updates), nil
+}
+
+func makeSWIMMsg(kind byte, seq uint64) []byte {
+	return appendUvarint([]byte{kind}, seq)
+}
+
+// memberUpdates are judgements of peers, encoded as
+//
+//	entries        uvarint count
+//	  name         peer name bytes, as for gossip msgs
+//	  incarnation  uvarint
+//	  state        uvarint
+type memberUpdates map[PeerName]memberEntry
+
+// Encode implements GossipData.
+func (u memberUpdates) Encode() [][]byte {
+	buf := appendUvarint(nil, uint64(len(u)))
+	for name, entry := range u {
+		buf = appendBytes(buf, name.bytes())
+		buf = appendUvarint(buf, entry.Incarnation)
+		buf = appendUvarint(buf, uint64(entry.State))
+	}
+	return [][]byte{buf}
+}
+
+// Merge implements GossipData, keeping the later judgement of each peer.
+// It makes a new memberUpdates, since broadcasts are shared between
+// connections.
+func (u memberUpdates) Merge(other GossipData) GossipData {
+	merged := make(memberUpdates, len(u))
+	for name, entry := range u {
+		merged[name] = entry
+	}
+	for name, entry := range other.(memberUpdates) {
+		if existing, found := merged[name]; !found || entry.supersedes(existing) {
+			merged[name] = entry
+		}
+	}
+	return merged
+}
+
+func decodeMemberUpdates(buf []byte) (memberUpdates, error) {
+	entries, n := binary.Uvarint(buf)
+	if n <= 0 || entries > uint64(len(buf)) {
+		return nil, errMalformedGossip
+	}
+	buf = buf[n:]
+	updates := make(memberUpdates, entries)
+	for i := uint64(0); i < entries; i++ {
+		name, rest, err := readBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		var nums []uint64
+		if nums, buf, err = readUvarints(rest, 2); err != nil {
+			return nil, err
+		}
+		if nums[1] > uint64(MemberDead) {
+			return nil, errMalformedGossip
+		}
+		updates[PeerNameFromBin(name)] = memberEntry{Incarnation: nums[0], State: MemberState(nums[1])}
+	}
+	return updates, nil
+}
@@ -0,0 +1,108 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureDetector(t *testing.T) {
+	network := NewMemTransport()
+	config := FailureDetectorConfig{ProbeInterval: 50 * time.Millisecond, ProbeTimeout: 40 * time.Millisecond, SuspicionTimeout: 200 * time.Millisecond}
+	var routers []*Router
+	var detectors []*FailureDetector
+	for i := 1; i <= 3; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		fd, err := router.NewFailureDetector(config)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, detectors = append(routers, router), append(detectors, fd)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	_, err := routers[0].NewFailureDetector(config)
+	require.Error(t, err, "second detector")
+
+	for _, router := range routers[1:] {
+		router.ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+	}
+	waitFor(t, "topology", func() bool {
+		return len(routers[1].Peers.names()) == 3 && len(routers[2].Peers.names()) == 3
+	})
+
+	// Peer 3 stops answering probes, though still connected.
+	require.NoError(t, routers[2].CloseGossip(failureDetectorChannel, false))
+	dead := routers[2].Ourself.Name
+	for _, fd := range detectors[:2] {
+		fd := fd
+		waitFor(t, "peer 3 dead", func() bool { return fd.State(dead) == MemberDead })
+	}
+	for _, status := range detectors[0].Members() {
+		if status.Name != dead {
+			require.Equal(t, MemberAlive, status.State, status.Name)
+		}
+	}
+}
+
+func TestFailureDetectorRefutation(t *testing.T) {
+	name, err := PeerNameFromString("01:00:00:00:00:01")
+	require.NoError(t, err)
+	router, err := NewRouter(Config{}, name, "1", nil)
+	require.NoError(t, err)
+	defer router.Stop(context.Background())
+	fd, err := router.NewFailureDetector(FailureDetectorConfig{})
+	require.NoError(t, err)
+
+	other := PeerName(2)
+	update := memberUpdates{name: {Incarnation: 3, State: MemberSuspect}, other: {Incarnation: 1, State: MemberSuspect}}
+	delta, err := fd.OnGossipBroadcast(other, update.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, memberUpdates{other: {Incarnation: 1, State: MemberSuspect}}, delta)
+	require.Equal(t, memberEntry{Incarnation: 4, State: MemberAlive}, fd.self)
+
+	// Stale and less severe judgements are ignored.
+	update = memberUpdates{other: {Incarnation: 1, State: MemberAlive}, name: {Incarnation: 2, State: MemberDead}}
+	delta, err = fd.OnGossip(update.Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, delta)
+	require.Equal(t, MemberSuspect, fd.State(other))
+	require.Equal(t, uint64(4), fd.self.Incarnation)
+
+	require.NoError(t, router.Stop(context.Background()))
+	_, err = router.NewFailureDetector(FailureDetectorConfig{})
+	require.Equal(t, errRouterStopped, err)
+}
+
+func TestFailureDetectorAcks(t *testing.T) {
+	name, err := PeerNameFromString("01:00:00:00:00:01")
+	require.NoError(t, err)
+	router, err := NewRouter(Config{}, name, "1", nil)
+	require.NoError(t, err)
+	defer router.Stop(context.Background())
+	fd, err := router.NewFailureDetector(FailureDetectorConfig{})
+	require.NoError(t, err)
+
+	target, helper, other := PeerName(2), PeerName(3), PeerName(4)
+	seq, acked := fd.expectAck(target)
+	ack := makeSWIMMsg(swimAck, seq)
+	require.NoError(t, fd.OnGossipUnicast(other, ack))
+	require.NoError(t, fd.OnGossipUnicast(helper, ack))
+	select {
+	case <-acked:
+		require.FailNow(t, "acked by a peer not asked")
+	default:
+	}
+	fd.expectAckFrom(seq, []PeerName{helper})
+	require.NoError(t, fd.OnGossipUnicast(helper, ack))
+	<-acked
+	require.NoError(t, fd.OnGossipUnicast(target, ack), "duplicate ack")
+}
@@ -1,6 +1,11 @@
 package mesh
 
-import "sync"
+import (
+	"context"
+	"sync"
+
+	"github.com/branthz/utarrow/lib/log"
+)
 
 // Gossip is the sending interface.
 //
@@ -27,6 +32,19 @@ type Gossip interface {
 	GossipNeighbourSubset(update GossipData)
 }
 
+// QueryGossip is a Gossip which can also emit queries. The Gossip returned
+// by Router.NewGossip is always a QueryGossip.
+type QueryGossip interface {
+	Gossip
+
+	// GossipQuery emits a query to all peers in the mesh, and passes
+	// their replies, ours included, to onReply as they arrive. It returns
+	// once every peer known when it was called has replied, or ctx is
+	// done, in which case it returns the peers yet to reply along with
+	// ctx's error.
+	GossipQuery(ctx context.Context, query []byte, onReply func(QueryReply)) (missing []PeerName, err error)
+}
+
 // Gossiper is the receiving interface.
 //
 // TODO(pb): rename to e.g. Receiver
@@ -51,6 +69,41 @@ type Gossiper interface {
 	OnGossip(msg []byte) (delta GossipData, err error)
 }
 
+// QueryGossiper is a Gossiper which also answers queries emitted with
+// QueryGossip.GossipQuery. Peers whose Gossiper is not a QueryGossiper reply
+// with a *QueryError.
+type QueryGossiper interface {
+	Gossiper
+
+	// OnGossipQuery returns the reply to a query from src.
+	OnGossipQuery(src PeerName, query []byte) (reply []byte, err error)
+}
+
+// DigestGossiper is a Gossiper whose state can be summarised in a digest,
+// e.g. a list of versions or a Merkle root. Periodic gossip with peers
+// able to exchange digests then sends just our digest; each end replies
+// with what the other's digest shows it lacks, and the receiving end with
+// its own digest too. Gossip is called only for peers unable to exchange
+// digests.
+type DigestGossiper interface {
+	Gossiper
+
+	// Digest returns a summary of our state.
+	Digest() []byte
+
+	// DiffFromDigest returns the part of our state missing from, or newer
+	// than, the state summarised by a remote's digest, or nil if there is
+	// none. The remote merges it with OnGossip.
+	DiffFromDigest(digest []byte) GossipData
+}
+
+// GossipDataSizer is implemented by GossipData able to report the size of
+// their encoding cheaply. Others are encoded to measure them, when there
+// is a limit on queued gossip to enforce.
+type GossipDataSizer interface {
+	Size() int
+}
+
 // GossipData is a merge-able dataset.
 // Think: log-structured data.
 type GossipData interface {
@@ -68,20 +121,41 @@ type GossipData interface {
 // channel.
 type gossipSender struct {
 	sync.Mutex
-	makeMsg          func(msg []byte) protocolMsg
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg
+	makeMsg          func(msg []byte) (protocolMsg, error)
+	makeBroadcastMsg func(srcName PeerName, msg []byte) (protocolMsg, error)
+	makeDigestMsg    func(msg []byte) (protocolMsg, error)
 	sender           protocolSender
+	queue            *gossipQueue     // the connection's
+	scheduler        *gossipScheduler // the connection's
+	priority         GossipPriority
+	limit            int               // on queued bytes; zero for none
+	policy           GossipQueuePolicy // when over either limit
+	queued           int               // bytes, in gossip and broadcasts
+	digest           GossipData
 	gossip           GossipData
+	gossipSize       int
 	broadcasts       map[PeerName]GossipData
+	broadcastSizes   map[PeerName]int
+	seq              uint64              // counts the gossip and broadcasts queued afresh
+	gossipSeq        uint64              // of gossip, when first queued; see dropOldest
+	broadcastSeqs    map[PeerName]uint64 // likewise, of broadcasts
 	more             chan<- struct{}
 	flush            chan<- chan<- bool // for testing
+	finished         chan struct{}      // closed to signal that run has finished
+	quit             chan struct{}      // closed to stop just this sender
 }
 
 // NewGossipSender constructs a usable GossipSender.
 func newGossipSender(
-	makeMsg func(msg []byte) protocolMsg,
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg,
+	makeMsg func(msg []byte) (protocolMsg, error),
+	makeBroadcastMsg func(srcName PeerName, msg []byte) (protocolMsg, error),
+	makeDigestMsg func(msg []byte) (protocolMsg, error),
 	sender protocolSender,
+	queue *gossipQueue,
+	scheduler *gossipScheduler,
+	priority GossipPriority,
+	limit int,
+	policy GossipQueuePolicy,
 	stop <-chan struct{},
 ) *gossipSender {
 	more := make(chan struct{}, 1)
@@ -89,21 +163,34 @@ func newGossipSender(
 	s := &gossipSender{
 		makeMsg:          makeMsg,
 		makeBroadcastMsg: makeBroadcastMsg,
+		makeDigestMsg:    makeDigestMsg,
 		sender:           sender,
+		queue:            queue,
+		scheduler:        scheduler,
+		priority:         priority,
+		limit:            limit,
+		policy:           policy,
 		broadcasts:       make(map[PeerName]GossipData),
+		broadcastSizes:   make(map[PeerName]int),
+		broadcastSeqs:    make(map[PeerName]uint64),
 		more:             more,
 		flush:            flush,
+		finished:         make(chan struct{}),
+		quit:             make(chan struct{}),
 	}
 	go s.run(stop, more, flush)
 	return s
 }
 
 func (s *gossipSender) run(stop <-chan struct{}, more <-chan struct{}, flush <-chan chan<- bool) {
+	defer close(s.finished)
 	sent := false
 	for {
 		select {
 		case <-stop:
 			return
+		case <-s.quit:
+			return
 		case <-more:
 			sentSomething, err := s.deliver(stop)
 			if err != nil {
@@ -138,14 +225,25 @@ func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 		select {
 		case <-stop:
 			return sent, nil
+		case <-s.quit:
+			return sent, nil
 		default:
 		}
 		data, makeProtocolMsg := s.pick()
 		if data == nil {
 			return sent, nil
 		}
+		turns := &gossipTurns{s.scheduler, s.priority, stop, s.quit}
 		for _, msg := range data.Encode() {
-			if err := s.sender.SendProtocolMsg(makeProtocolMsg(msg)); err != nil {
+			m, err := makeProtocolMsg(msg)
+			if err == nil {
+				err = s.send(m, turns)
+			}
+			if err == errNoTurn {
+				return sent, nil
+			} else if isMessageTooLarge(err) {
+				log.Info("dropping gossip: %v", err)
+			} else if err != nil {
 				return sent, err
 			}
 		}
@@ -153,57 +251,108 @@ func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 	}
 }
 
-func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(msg []byte) protocolMsg) {
+// send sends m taking turns, one for each frame if the sender sends
+// frames in turns itself.
+func (s *gossipSender) send(m protocolMsg, turns *gossipTurns) error {
+	if sender, ok := s.sender.(turnTakingSender); ok {
+		return sender.sendInTurns(m, turns)
+	}
+	return turns.send(func() error { return s.sender.SendProtocolMsg(m) })
+}
+
+func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(msg []byte) (protocolMsg, error)) {
 	s.Lock()
 	defer s.Unlock()
 	switch {
+	case s.digest != nil: // small, and prompting replies
+		data = s.digest
+		makeProtocolMsg = s.makeDigestMsg
+		s.digest = nil
 	case s.gossip != nil: // usually more important than broadcasts
 		data = s.gossip
 		makeProtocolMsg = s.makeMsg
 		s.gossip = nil
+		s.dequeued(s.gossipSize)
+		s.gossipSize = 0
 	case len(s.broadcasts) > 0:
 		for srcName, d := range s.broadcasts {
 			data = d
-			makeProtocolMsg = func(msg []byte) protocolMsg { return s.makeBroadcastMsg(srcName, msg) }
-			delete(s.broadcasts, srcName)
+			makeProtocolMsg = func(msg []byte) (protocolMsg, error) { return s.makeBroadcastMsg(srcName, msg) }
+			s.dequeued(s.broadcastSizes[srcName])
+			s.removeBroadcast(srcName)
 			break
 		}
 	}
 	return
 }
 
-// Send accumulates the GossipData and will send it eventually.
-// Send and Broadcast accumulate into different buckets.
-func (s *gossipSender) Send(data GossipData) {
+// removeBroadcast forgets the broadcasts queued from srcName, leaving the
+// caller to account for their size. Must hold the lock.
+func (s *gossipSender) removeBroadcast(srcName PeerName) {
+	delete(s.broadcasts, srcName)
+	delete(s.broadcastSizes, srcName)
+	delete(s.broadcastSeqs, srcName)
+}
+
+// Send accumulates the GossipData, of the given size (see
+// gossipChannel.size), and will send it eventually. Send and Broadcast
+// accumulate into different buckets. Under GossipBlock, they wait for room
+// only if block is set.
+func (s *gossipSender) Send(data GossipData, size int, block bool) {
 	s.Lock()
 	defer s.Unlock()
+	if !s.makeRoom(size, block) {
+		return
+	}
 	if s.empty() {
 		defer s.prod()
 	}
 	if s.gossip == nil {
-		s.gossip = data
+		s.seq++
+		s.gossip, s.gossipSeq = data, s.seq
 	} else {
 		s.gossip = s.gossip.Merge(data)
 	}
+	s.gossipSize += size
+	s.enqueued(size)
+}
+
+// SendDigest will send digest eventually, in place of any digest not yet
+// sent.
+func (s *gossipSender) SendDigest(digest []byte) {
+	s.Lock()
+	defer s.Unlock()
+	if s.empty() {
+		defer s.prod()
+	}
+	s.digest = digestData(digest)
 }
 
 // Broadcast accumulates the GossipData under the given srcName and will send
-// it eventually. Send and Broadcast accumulate into different buckets.
-func (s *gossipSender) Broadcast(srcName PeerName, data GossipData) {
+// it eventually, as for Send.
+func (s *gossipSender) Broadcast(srcName PeerName, data GossipData, size int, block bool) {
 	s.Lock()
 	defer s.Unlock()
+	if !s.makeRoom(size, block) {
+		return
+	}
 	if s.empty() {
 		defer s.prod()
 	}
 	d, found := s.broadcasts[srcName]
 	if !found {
-		s.broadcasts[srcName] = data
+		s.seq++
+		s.broadcasts[srcName], s.broadcastSeqs[srcName] = data, s.seq
 	} else {
 		s.broadcasts[srcName] = d.Merge(data)
 	}
+	s.broadcastSizes[srcName] += size
+	s.enqueued(size)
 }
 
-func (s *gossipSender) empty() bool { return s.gossip == nil && len(s.broadcasts) == 0 }
+func (s *gossipSender) empty() bool {
+	return s.digest == nil && s.gossip == nil && len(s.broadcasts) == 0
+}
 
 func (s *gossipSender) prod() {
 	select {
@@ -220,39 +369,82 @@ func (s *gossipSender) Flush() bool {
 	return <-ch
 }
 
+// drain sends all pending data. It gives up when ctx is done or the sender
+// has stopped.
+func (s *gossipSender) drain(ctx context.Context) {
+	ch := make(chan bool, 1)
+	select {
+	case s.flush <- ch:
+	case <-s.finished:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ch:
+	case <-s.finished:
+	case <-ctx.Done():
+	}
+}
+
 // gossipSenders wraps a ProtocolSender (e.g. a LocalConnection) and yields
 // per-channel GossipSenders.
 // TODO(pb): may be able to remove this and use makeGossipSender directly
 type gossipSenders struct {
 	sync.Mutex
-	sender  protocolSender
-	stop    <-chan struct{}
-	senders map[string]*gossipSender
+	sender    protocolSender
+	queue     *gossipQueue
+	scheduler *gossipScheduler
+	stop      <-chan struct{}
+	senders   map[string]*gossipSender
 }
 
 // NewGossipSenders returns a usable GossipSenders leveraging the ProtocolSender.
 // TODO(pb): is stop chan the best way to do that?
-func newGossipSenders(sender protocolSender, stop <-chan struct{}) *gossipSenders {
+func newGossipSenders(sender protocolSender, queueLimit int, stop <-chan struct{}) *gossipSenders {
 	return &gossipSenders{
-		sender:  sender,
-		stop:    stop,
-		senders: make(map[string]*gossipSender),
+		sender:    sender,
+		queue:     newGossipQueue(queueLimit),
+		scheduler: &gossipScheduler{},
+		stop:      stop,
+		senders:   make(map[string]*gossipSender),
 	}
 }
 
 // Sender yields the GossipSender for the named channel.
-// It will use the factory function if no sender yet exists.
-func (gs *gossipSenders) Sender(channelName string, makeGossipSender func(sender protocolSender, stop <-chan struct{}) *gossipSender) *gossipSender {
+// It will use the factory function if no sender yet exists, unless the
+// channel is closed, when it yields nil. closed is checked holding the
+// lock, so that once a channel is closed and its sender removed, no
+// sender is made for it afresh.
+func (gs *gossipSenders) Sender(channelName string, closed func() bool, makeGossipSender func(sender protocolSender, queue *gossipQueue, scheduler *gossipScheduler, stop <-chan struct{}) *gossipSender) *gossipSender {
 	gs.Lock()
 	defer gs.Unlock()
 	s, found := gs.senders[channelName]
 	if !found {
-		s = makeGossipSender(gs.sender, gs.stop)
+		if closed() {
+			return nil
+		}
+		s = makeGossipSender(gs.sender, gs.queue, gs.scheduler, gs.stop)
 		gs.senders[channelName] = s
 	}
 	return s
 }
 
+// remove stops and forgets the sender for the named channel, discarding
+// whatever it has yet to send.
+func (gs *gossipSenders) remove(channelName string) {
+	gs.Lock()
+	s, found := gs.senders[channelName]
+	delete(gs.senders, channelName)
+	gs.Unlock()
+	if found {
+		s.Lock()
+		s.discard()
+		s.Unlock()
+		close(s.quit)
+	}
+}
+
 // Flush flushes all managed senders. Used for testing.
 func (gs *gossipSenders) Flush() bool {
 	sent := false
@@ -264,6 +456,32 @@ func (gs *gossipSenders) Flush() bool {
 	return sent
 }
 
+// drain sends all pending data of all managed senders, giving up when ctx
+// is done.
+func (gs *gossipSenders) drain(ctx context.Context) {
+	for _, sender := range gs.snapshot() {
+		sender.drain(ctx)
+	}
+}
+
+// wait blocks until all managed senders have stopped. It must only be
+// called once stop has been closed.
+func (gs *gossipSenders) wait() {
+	for _, sender := range gs.snapshot() {
+		<-sender.finished
+	}
+}
+
+func (gs *gossipSenders) snapshot() []*gossipSender {
+	gs.Lock()
+	defer gs.Unlock()
+	senders := make([]*gossipSender, 0, len(gs.senders))
+	for _, sender := range gs.senders {
+		senders = append(senders, sender)
+	}
+	return senders
+}
+
 // GossipChannels is an index of channel name to gossip channel.
 type gossipChannels map[string]*gossipChannel
 
@@ -1,9 +1,9 @@
 package mesh
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/branthz/utarrow/lib/log"
 )
@@ -14,6 +14,16 @@ type gossipChannel struct {
 	ourself  *localPeer
 	routes   *routes
 	gossiper Gossiper
+	fanout   int           // of relay and periodic gossip; zero selects the default
+	quit     chan struct{} // closed when the channel is closed
+
+	queueLimit  int // per connection; see GossipConfig.QueueBytes
+	queuePolicy GossipQueuePolicy
+	priority    GossipPriority
+
+	queryLock   sync.Mutex
+	nextQueryID uint64
+	queries     map[uint64]chan<- QueryReply // by ID, of our queries awaiting replies
 }
 
 // newGossipChannel returns a named, usable channel.
@@ -24,135 +34,177 @@ func newGossipChannel(channelName string, ourself *localPeer, r *routes, g Gossi
 		ourself:  ourself,
 		routes:   r,
 		gossiper: g,
+		queries:  make(map[uint64]chan<- QueryReply),
+		quit:     make(chan struct{}),
 	}
 }
 
-func (c *gossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
-	var destName PeerName
-	if err := dec.Decode(&destName); err != nil {
-		return err
+func (c *gossipChannel) deliverUnicast(m gossipMsg) error {
+	if c.ourself.Name == m.dstName {
+		return c.gossiper.OnGossipUnicast(m.srcName, m.payload)
 	}
-	if c.ourself.Name == destName {
-		var payload []byte
-		if err := dec.Decode(&payload); err != nil {
-			return err
-		}
-		return c.gossiper.OnGossipUnicast(srcName, payload)
-	}
-	if err := c.relayUnicast(destName, origPayload); err != nil {
+	if err := c.relayUnicast(ProtocolGossipUnicast, m); err != nil {
 		c.logf("%v", err)
 	}
 	return nil
 }
 
-func (c *gossipChannel) deliverBroadcast(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
-		return err
-	}
+func (c *gossipChannel) deliverBroadcast(srcName PeerName, payload []byte) error {
 	data, err := c.gossiper.OnGossipBroadcast(srcName, payload)
 	if err != nil || data == nil {
 		return err
 	}
-	c.relayBroadcast(srcName, data)
+	c.relayBroadcast(srcName, data, false)
 	return nil
 }
 
-func (c *gossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
-		return err
-	}
+func (c *gossipChannel) deliver(srcName PeerName, payload []byte) error {
 	update, err := c.gossiper.OnGossip(payload)
 	if err != nil || update == nil {
 		return err
 	}
-	c.relay(srcName, update)
+	c.relay(srcName, update, false)
 	return nil
 }
 
 // GossipUnicast implements Gossip, relaying msg to dst, which must be a
 // member of the channel.
 func (c *gossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
-	return c.relayUnicast(dstPeerName, gobEncode(c.name, c.ourself.Name, dstPeerName, msg))
+	if c.closed() {
+		return errGossipClosed
+	}
+	return c.relayUnicast(ProtocolGossipUnicast, gossipMsg{channelName: c.name, srcName: c.ourself.Name, dstName: dstPeerName, payload: msg})
 }
 
 // GossipBroadcast implements Gossip, relaying update to all members of the
 // channel.
 func (c *gossipChannel) GossipBroadcast(update GossipData) {
-	c.relayBroadcast(c.ourself.Name, update)
+	if c.closed() {
+		return
+	}
+	c.relayBroadcast(c.ourself.Name, update, true)
 }
 
 // GossipNeighbourSubset implements Gossip, relaying update to subset of members of the
 // channel.
 func (c *gossipChannel) GossipNeighbourSubset(update GossipData) {
-	c.relay(c.ourself.Name, update)
+	if c.closed() {
+		return
+	}
+	c.relay(c.ourself.Name, update, true)
 }
 
 // Send relays data into the channel topology via random neighbours.
 func (c *gossipChannel) Send(data GossipData) {
-	c.relay(c.ourself.Name, data)
+	c.relay(c.ourself.Name, data, false)
 }
 
 // SendDown relays data into the channel topology via conn.
 func (c *gossipChannel) SendDown(conn Connection, data GossipData) {
-	c.senderFor(conn).Send(data)
+	if sender := c.senderFor(conn); sender != nil {
+		sender.Send(data, c.size(data), false)
+	}
 }
 
-func (c *gossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) (err error) {
-	if relayPeerName, found := c.routes.UnicastAll(dstPeerName); !found {
-		err = fmt.Errorf("unknown relay destination: %s", dstPeerName)
+// relayUnicast sends m, a msg with tag, on towards its destination,
+// encoded as suits the connection it leaves by.
+func (c *gossipChannel) relayUnicast(tag protocolTag, m gossipMsg) (err error) {
+	if relayPeerName, found := c.routes.UnicastAll(m.dstName); !found {
+		err = fmt.Errorf("unknown relay destination: %s", m.dstName)
 	} else if conn, found := c.ourself.ConnectionTo(relayPeerName); !found {
 		err = fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)
+	} else if tag == ProtocolGossipQueryReply && !answersQueries(conn) {
+		err = fmt.Errorf("relay peer %s does not support queries", relayPeerName)
 	} else {
-		err = conn.(protocolSender).SendProtocolMsg(protocolMsg{ProtocolGossipUnicast, buf})
+		var buf []byte
+		if buf, err = gossipCodecFor(conn).encode(tag, m); err == nil {
+			err = conn.(protocolSender).SendProtocolMsg(protocolMsg{tag, buf})
+		}
 	}
 	return err
 }
 
-func (c *gossipChannel) relayBroadcast(srcName PeerName, update GossipData) {
+// relayBroadcast queues update for the next peers of the broadcast tree
+// rooted at srcName. block is for gossip emitted by the application; see
+// GossipBlock.
+func (c *gossipChannel) relayBroadcast(srcName PeerName, update GossipData, block bool) {
 	c.routes.ensureRecalculated()
+	size := c.size(update)
 	for _, conn := range c.ourself.ConnectionsTo(c.routes.BroadcastAll(srcName)) {
-		c.senderFor(conn).Broadcast(srcName, update)
+		if sender := c.senderFor(conn); sender != nil {
+			sender.Broadcast(srcName, update, size, block)
+		}
 	}
 }
 
-func (c *gossipChannel) relay(srcName PeerName, data GossipData) {
+// relay queues data for random neighbours, as for relayBroadcast.
+func (c *gossipChannel) relay(srcName PeerName, data GossipData, block bool) {
 	c.routes.ensureRecalculated()
-	for _, conn := range c.ourself.ConnectionsTo(c.routes.randomNeighbours(srcName)) {
-		c.senderFor(conn).Send(data)
+	size := c.size(data)
+	for _, conn := range c.ourself.ConnectionsTo(c.routes.randomNeighbours(srcName, c.fanout)) {
+		if sender := c.senderFor(conn); sender != nil {
+			sender.Send(data, size, block)
+		}
 	}
 }
 
+// senderFor returns the sender for conn, or nil once we are closed.
 func (c *gossipChannel) senderFor(conn Connection) *gossipSender {
-	return conn.(gossipConnection).gossipSenders().Sender(c.name, c.makeGossipSender)
+	return conn.(gossipConnection).gossipSenders().Sender(c.name, c.closed, c.makeGossipSender)
 }
 
-func (c *gossipChannel) makeGossipSender(sender protocolSender, stop <-chan struct{}) *gossipSender {
-	return newGossipSender(c.makeMsg, c.makeBroadcastMsg, sender, stop)
+func (c *gossipChannel) makeGossipSender(sender protocolSender, queue *gossipQueue, scheduler *gossipScheduler, stop <-chan struct{}) *gossipSender {
+	codec := gossipCodecFor(sender)
+	encode := func(tag protocolTag, srcName PeerName, msg []byte) (protocolMsg, error) {
+		buf, err := codec.encode(tag, gossipMsg{channelName: c.name, srcName: srcName, payload: msg})
+		return protocolMsg{tag, buf}, err
+	}
+	makeMsg := func(msg []byte) (protocolMsg, error) {
+		return encode(ProtocolGossip, c.ourself.Name, msg)
+	}
+	makeBroadcastMsg := func(srcName PeerName, msg []byte) (protocolMsg, error) {
+		return encode(ProtocolGossipBroadcast, srcName, msg)
+	}
+	makeDigestMsg := func(msg []byte) (protocolMsg, error) {
+		return encode(ProtocolGossipDigest, c.ourself.Name, msg)
+	}
+	return newGossipSender(makeMsg, makeBroadcastMsg, makeDigestMsg, sender, queue, scheduler, c.priority, c.queueLimit, c.queuePolicy, stop)
+}
+
+// gossipLoop periodically relays our state, or its digest, via random
+// neighbours, until quit is closed.
+func (c *gossipChannel) gossipLoop(interval time.Duration, quit <-chan struct{}) {
+	defer c.ourself.router.untrack()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sendGossip()
+		case <-quit:
+			return
+		case <-c.quit:
+			return
+		}
+	}
 }
 
-func (c *gossipChannel) makeMsg(msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossip, gobEncode(c.name, c.ourself.Name, msg)}
+func (c *gossipChannel) stop() {
+	close(c.quit)
 }
 
-func (c *gossipChannel) makeBroadcastMsg(srcName PeerName, msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossipBroadcast, gobEncode(c.name, srcName, msg)}
+func (c *gossipChannel) closed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
 }
 
+var errGossipClosed = fmt.Errorf("gossip channel closed")
+
 func (c *gossipChannel) logf(format string, args ...interface{}) {
 	format = "[gossip " + c.name + "]: " + format
 	log.Info(format, args...)
 }
-
-// GobEncode gob-encodes each item and returns the resulting byte slice.
-func gobEncode(items ...interface{}) []byte {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	for _, i := range items {
-		if err := enc.Encode(i); err != nil {
-			panic(err)
-		}
-	}
-	return buf.Bytes()
-}
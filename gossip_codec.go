@@ -0,0 +1,282 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"sync"
+)
+
+// Gossip msgs carry the name of their channel, the name of the peer they
+// originate from, the name of the peer they are destined for (unicasts
+// and query replies only), and a payload. How these are encoded depends on the protocol
+// version of the connection.
+//
+// Protocol V1 and V2 gob-encode each of them in turn. That is costly, as a
+// fresh gob encoder re-sends type information with every msg, and hard to
+// implement outside Go. So from V3 the encoding is compact and binary:
+//
+//	tag          1 byte, the protocolTag that starts every protocol msg
+//	channel      uvarint length, followed by the UTF-8 channel name
+//	source       uvarint length, followed by the peer name's bytes
+//	destination  as source; present only where hasDestination
+//	payload      all remaining bytes
+//
+// A peer name's bytes are the 6-byte MAC for the "mac" PeerNameFlavour,
+// and the hex-decoded name for the "hash" flavour.
+//
+// If both ends of a V3 connection have the "ChannelIDs" feature, the
+// channel is instead given as a uvarint ID; see internedGossipCodec.
+type gossipMsg struct {
+	channelName string
+	srcName     PeerName
+	dstName     PeerName // for unicasts and query replies only
+	payload     []byte
+}
+
+// gossipCodec converts gossipMsgs to and from the payloads of protocol
+// msgs with the given tag.
+type gossipCodec interface {
+	encode(tag protocolTag, m gossipMsg) ([]byte, error)
+	decode(tag protocolTag, payload []byte) (gossipMsg, error)
+}
+
+// gossipCodecConnection is implemented by connections which know the
+// gossipCodec of their protocol version. Others get gobGossipCodec.
+type gossipCodecConnection interface {
+	gossipCodec() gossipCodec
+}
+
+// gossipCodecFor returns the gossipCodec to send msgs on conn with.
+func gossipCodecFor(conn interface{}) gossipCodec {
+	if conn, ok := conn.(gossipCodecConnection); ok {
+		return conn.gossipCodec()
+	}
+	return gobGossipCodec{}
+}
+
+// gossipCodecForVersion returns the gossipCodec of a protocol version.
+func gossipCodecForVersion(version byte) gossipCodec {
+	if version >= 3 {
+		return binaryGossipCodec{}
+	}
+	return gobGossipCodec{}
+}
+
+// hasDestination reports whether gossip msgs with tag are addressed to a
+// single peer.
+func hasDestination(tag protocolTag) bool {
+	return tag == ProtocolGossipUnicast || tag == ProtocolGossipQueryReply
+}
+
+// gobGossipCodec implements gossipCodec for protocol V1 and V2.
+type gobGossipCodec struct{}
+
+func (gobGossipCodec) encode(tag protocolTag, m gossipMsg) ([]byte, error) {
+	if hasDestination(tag) {
+		return gobEncode(m.channelName, m.srcName, m.dstName, m.payload), nil
+	}
+	return gobEncode(m.channelName, m.srcName, m.payload), nil
+}
+
+func (gobGossipCodec) decode(tag protocolTag, payload []byte) (m gossipMsg, err error) {
+	decoder := gob.NewDecoder(bytes.NewReader(payload))
+	if err = decoder.Decode(&m.channelName); err != nil {
+		return
+	}
+	if err = decoder.Decode(&m.srcName); err != nil {
+		return
+	}
+	if hasDestination(tag) {
+		if err = decoder.Decode(&m.dstName); err != nil {
+			return
+		}
+	}
+	err = decoder.Decode(&m.payload)
+	return
+}
+
+// GobEncode gob-encodes each item and returns the resulting byte slice.
+func gobEncode(items ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for _, i := range items {
+		if err := enc.Encode(i); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// binaryGossipCodec implements gossipCodec for protocol V3.
+type binaryGossipCodec struct{}
+
+func (binaryGossipCodec) encode(tag protocolTag, m gossipMsg) ([]byte, error) {
+	return encodeBinaryGossip(appendBytes(nil, []byte(m.channelName)), tag, m), nil
+}
+
+func (binaryGossipCodec) decode(tag protocolTag, payload []byte) (gossipMsg, error) {
+	return decodeBinaryGossip(tag, payload, func(buf []byte) (string, []byte, error) {
+		channelName, rest, err := readBytes(buf)
+		return string(channelName), rest, err
+	})
+}
+
+// encodeBinaryGossip encodes m following channel, the already encoded
+// channel field.
+func encodeBinaryGossip(channel []byte, tag protocolTag, m gossipMsg) []byte {
+	src := m.srcName.bytes()
+	var dst []byte
+	if hasDestination(tag) {
+		dst = m.dstName.bytes()
+	}
+	buf := make([]byte, 0, len(channel)+2*binary.MaxVarintLen64+len(src)+len(dst)+len(m.payload))
+	buf = append(buf, channel...)
+	buf = appendBytes(buf, src)
+	if hasDestination(tag) {
+		buf = appendBytes(buf, dst)
+	}
+	return append(buf, m.payload...)
+}
+
+// decodeBinaryGossip decodes what encodeBinaryGossip encoded, reading the
+// channel field with readChannel.
+func decodeBinaryGossip(tag protocolTag, payload []byte, readChannel func([]byte) (string, []byte, error)) (m gossipMsg, err error) {
+	var src, dst []byte
+	if m.channelName, payload, err = readChannel(payload); err != nil {
+		return
+	}
+	if src, payload, err = readBytes(payload); err != nil {
+		return
+	}
+	if hasDestination(tag) {
+		if dst, payload, err = readBytes(payload); err != nil {
+			return
+		}
+		m.dstName = PeerNameFromBin(dst)
+	}
+	m.srcName = PeerNameFromBin(src)
+	m.payload = payload
+	return
+}
+
+// internedGossipCodec implements gossipCodec for protocol V3 connections
+// whose ends agree, through the "ChannelIDs" feature, to send channel IDs
+// in place of channel names. Each end numbers the channels it sends on
+// from 1 upwards, in the order it first sends on them, and announces
+// each number in a ProtocolChannelID msg, consisting of the uvarint ID
+// followed by the channel name, before using it. Only the first
+// maxChannelIDs channels are numbered, so that neither end's table grows
+// without bound however many channels come and go; msgs on any others
+// carry an ID of 0 followed by the channel name, as a uvarint length and
+// the name.
+//
+// This relies on msgs arriving in the order they were sent, as the
+// remote learns IDs from the same goroutine that decodes the gossip
+// using them. So an announcement must be sent, not merely queued, before
+// any msg using its ID; see channelID.
+type internedGossipCodec struct {
+	sync.Mutex
+	announce func(protocolMsg) error
+	sendIDs  map[string]uint64
+	// Names of the channels the remote numbered, indexed by ID-1. Only
+	// accessed by the receiving goroutine.
+	receiveNames []string
+}
+
+const maxChannelIDs = 1024
+
+func newInternedGossipCodec(announce func(protocolMsg) error) *internedGossipCodec {
+	return &internedGossipCodec{announce: announce, sendIDs: make(map[string]uint64)}
+}
+
+func (c *internedGossipCodec) encode(tag protocolTag, m gossipMsg) ([]byte, error) {
+	id, err := c.channelID(m.channelName)
+	if err != nil {
+		return nil, err
+	}
+	channel := appendUvarint(nil, id)
+	if id == 0 {
+		channel = appendBytes(channel, []byte(m.channelName))
+	}
+	return encodeBinaryGossip(channel, tag, m), nil
+}
+
+// channelID returns the ID of the named channel, numbering and announcing
+// it if need be. announce must send synchronously, and the lock is held
+// while it does, so that no msg using the ID can be sent ahead of the
+// announcement. Should the announcement fail, the channel is left
+// unnumbered, so that the next announcement takes its ID. The ID is 0 once
+// maxChannelIDs channels are numbered.
+func (c *internedGossipCodec) channelID(channelName string) (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if id, found := c.sendIDs[channelName]; found {
+		return id, nil
+	}
+	if len(c.sendIDs) >= maxChannelIDs {
+		return 0, nil
+	}
+	id := uint64(len(c.sendIDs) + 1)
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], id)
+	if err := c.announce(protocolMsg{ProtocolChannelID, append(buf[:n], channelName...)}); err != nil {
+		return 0, err
+	}
+	c.sendIDs[channelName] = id
+	return id, nil
+}
+
+func (c *internedGossipCodec) decode(tag protocolTag, payload []byte) (gossipMsg, error) {
+	return decodeBinaryGossip(tag, payload, func(buf []byte) (string, []byte, error) {
+		id, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return "", nil, errMalformedGossip
+		}
+		if id == 0 {
+			name, rest, err := readBytes(buf[n:])
+			return string(name), rest, err
+		}
+		if id > uint64(len(c.receiveNames)) {
+			return "", nil, fmt.Errorf("unknown gossip channel ID %d", id)
+		}
+		return c.receiveNames[id-1], buf[n:], nil
+	})
+}
+
+// learn records the channel ID announced in a ProtocolChannelID msg.
+func (c *internedGossipCodec) learn(payload []byte) error {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return errMalformedGossip
+	}
+	if id != uint64(len(c.receiveNames)+1) {
+		return fmt.Errorf("gossip channel ID %d announced out of sequence", id)
+	}
+	if id > maxChannelIDs {
+		return fmt.Errorf("gossip channel ID %d beyond the last, %d", id, maxChannelIDs)
+	}
+	c.receiveNames = append(c.receiveNames, string(payload[n:]))
+	return nil
+}
+
+// appendBytes appends b to buf, prefixed with its length as a uvarint.
+func appendBytes(buf, b []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	return append(append(buf, lenBuf[:n]...), b...)
+}
+
+// readBytes reads what appendBytes appended, returning it and the rest of
+// buf.
+func readBytes(buf []byte) (b, rest []byte, err error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || l > uint64(len(buf)-n) {
+		return nil, nil, errMalformedGossip
+	}
+	end := n + int(l)
+	return buf[n:end], buf[end:], nil
+}
+
+var errMalformedGossip = fmt.Errorf("malformed gossip msg")
@@ -0,0 +1,109 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipCodecs(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	dst, _ := PeerNameFromString("02:00:00:02:00:00")
+	for _, codec := range []gossipCodec{gobGossipCodec{}, binaryGossipCodec{}} {
+		for _, tag := range []protocolTag{ProtocolGossip, ProtocolGossipBroadcast, ProtocolGossipUnicast} {
+			m := gossipMsg{channelName: "test", srcName: src, payload: []byte("payload")}
+			if tag == ProtocolGossipUnicast {
+				m.dstName = dst
+			}
+			encoded, err := codec.encode(tag, m)
+			require.NoError(t, err)
+			decoded, err := codec.decode(tag, encoded)
+			require.NoError(t, err)
+			require.Equal(t, m, decoded)
+		}
+	}
+}
+
+func TestBinaryGossipCodec(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	dst, _ := PeerNameFromString("02:00:00:02:00:00")
+	m := gossipMsg{channelName: "ch", srcName: src, dstName: dst, payload: []byte{42}}
+	encoded, err := binaryGossipCodec{}.encode(ProtocolGossipUnicast, m)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		2, 'c', 'h',
+		6, 0x01, 0, 0, 0x01, 0, 0,
+		6, 0x02, 0, 0, 0x02, 0, 0,
+		42,
+	}, encoded)
+
+	for i := 0; i < len(encoded)-1; i++ {
+		_, err := binaryGossipCodec{}.decode(ProtocolGossipUnicast, encoded[:i])
+		require.Error(t, err, "truncated at %d", i)
+	}
+	decoded, err := binaryGossipCodec{}.decode(ProtocolGossipUnicast, encoded[:len(encoded)-1])
+	require.NoError(t, err)
+	require.Empty(t, decoded.payload)
+}
+
+func TestInternedGossipCodec(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	receiver := newInternedGossipCodec(nil)
+	var announcements int
+	var announceErr error
+	sender := newInternedGossipCodec(func(pm protocolMsg) error {
+		require.Equal(t, protocolTag(ProtocolChannelID), pm.tag)
+		if announceErr != nil {
+			return announceErr
+		}
+		announcements++
+		return receiver.learn(pm.msg)
+	})
+
+	for _, channelName := range []string{"topology", "counter", "topology", "counter"} {
+		m := gossipMsg{channelName: channelName, srcName: src, payload: []byte("payload")}
+		encoded, err := sender.encode(ProtocolGossip, m)
+		require.NoError(t, err)
+		unencoded, err := binaryGossipCodec{}.encode(ProtocolGossip, m)
+		require.NoError(t, err)
+		require.Len(t, encoded, len(unencoded)-len(channelName),
+			"the channel name should be replaced with a 1-byte ID")
+		decoded, err := receiver.decode(ProtocolGossip, encoded)
+		require.NoError(t, err)
+		require.Equal(t, m, decoded)
+	}
+	require.Equal(t, 2, announcements)
+
+	// A failed announcement must surface, and leave the ID to the next.
+	announceErr = fmt.Errorf("connection closed")
+	m := gossipMsg{channelName: "unannounced", srcName: src, payload: []byte("payload")}
+	_, err := sender.encode(ProtocolGossip, m)
+	require.Equal(t, announceErr, err)
+	announceErr = nil
+	encoded, err := sender.encode(ProtocolGossip, m)
+	require.NoError(t, err)
+	decoded, err := receiver.decode(ProtocolGossip, encoded)
+	require.NoError(t, err)
+	require.Equal(t, m, decoded)
+
+	// Beyond the last ID, channels go by name.
+	for i := announcements; i < maxChannelIDs; i++ {
+		_, err = sender.encode(ProtocolGossip, gossipMsg{channelName: fmt.Sprint(i), srcName: src})
+		require.NoError(t, err)
+	}
+	require.Equal(t, maxChannelIDs, announcements)
+	m = gossipMsg{channelName: "unnumbered", srcName: src, payload: []byte("payload")}
+	encoded, err = sender.encode(ProtocolGossip, m)
+	require.NoError(t, err)
+	require.Equal(t, maxChannelIDs, announcements)
+	decoded, err = receiver.decode(ProtocolGossip, encoded)
+	require.NoError(t, err)
+	require.Equal(t, m, decoded)
+	require.Len(t, receiver.receiveNames, maxChannelIDs)
+	require.Error(t, receiver.learn(append(appendUvarint(nil, maxChannelIDs+1), 'x')), "ID beyond the last")
+
+	_, err = newInternedGossipCodec(nil).decode(ProtocolGossip, []byte{1, 0})
+	require.Error(t, err, "unannounced ID")
+	require.Error(t, receiver.learn([]byte{5, 'x'}), "ID out of sequence")
+}
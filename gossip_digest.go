@@ -0,0 +1,101 @@
+package mesh
+
+// A ProtocolGossipDigest msg's payload is a kind byte followed by the
+// digest. Digests are exchanged only with peers whose connections have
+// the "Digests" feature, and are never relayed.
+const (
+	digestPush byte = iota // the remote replies with its own digest
+	digestPull
+)
+
+// digestConnection is implemented by connections which know whether
+// their remote exchanges digests. Others are sent complete state.
+type digestConnection interface {
+	exchangesDigests() bool
+}
+
+func exchangesDigests(conn Connection) bool {
+	dc, ok := conn.(digestConnection)
+	return ok && dc.exchangesDigests()
+}
+
+// sendGossip relays our state via random neighbours.
+func (c *gossipChannel) sendGossip() {
+	c.routes.ensureRecalculated()
+	c.sendGossipDown(c.ourself.ConnectionsTo(c.routes.randomNeighbours(c.ourself.Name, c.fanout))...)
+}
+
+// sendGossipDown relays our state via conns, or just its digest via those
+// which exchange digests, if our Gossiper is a DigestGossiper.
+func (c *gossipChannel) sendGossipDown(conns ...Connection) {
+	digester, digesting := c.gossiper.(DigestGossiper)
+	var digest []byte
+	var complete GossipData
+	var completeSize int
+	fetched := false
+	for _, conn := range conns {
+		if digesting && exchangesDigests(conn) {
+			if digest == nil {
+				digest = append([]byte{digestPush}, digester.Digest()...)
+			}
+			if sender := c.senderFor(conn); sender != nil {
+				sender.SendDigest(digest)
+			}
+			continue
+		}
+		if !fetched {
+			complete, fetched = c.gossiper.Gossip(), true
+			if complete != nil {
+				completeSize = c.size(complete)
+			}
+		}
+		if complete == nil {
+			continue
+		}
+		if sender := c.senderFor(conn); sender != nil {
+			sender.Send(complete, completeSize, false)
+		}
+	}
+}
+
+// deliverDigest replies to a digest from the neighbour src with what it
+// shows src lacks, and to a pushed digest with our own digest too.
+// Lacking a digest of our own, we reply with complete state.
+func (c *gossipChannel) deliverDigest(srcName PeerName, payload []byte) error {
+	if len(payload) < 1 {
+		return errMalformedGossip
+	}
+	conn, found := c.ourself.ConnectionTo(srcName)
+	if !found {
+		return nil
+	}
+	sender := c.senderFor(conn)
+	if sender == nil {
+		return nil
+	}
+	digester, digesting := c.gossiper.(DigestGossiper)
+	if !digesting {
+		if complete := c.gossiper.Gossip(); complete != nil {
+			sender.Send(complete, c.size(complete), false)
+		}
+		return nil
+	}
+	if diff := digester.DiffFromDigest(payload[1:]); diff != nil {
+		sender.Send(diff, c.size(diff), false)
+	}
+	if payload[0] == digestPush {
+		sender.SendDigest(append([]byte{digestPull}, digester.Digest()...))
+	}
+	return nil
+}
+
+// digestData wraps a digest for a gossipSender. Merging keeps the latest.
+type digestData []byte
+
+func (d digestData) Encode() [][]byte {
+	return [][]byte{d}
+}
+
+func (d digestData) Merge(other GossipData) GossipData {
+	return other
+}
@@ -0,0 +1,101 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// digestGossiper's digest lists the bytes it has.
+type digestGossiper struct {
+	fullGossips int32 // accessed atomically
+	*testGossiper
+}
+
+func (g *digestGossiper) Gossip() GossipData {
+	atomic.AddInt32(&g.fullGossips, 1)
+	return g.testGossiper.Gossip()
+}
+
+func (g *digestGossiper) Digest() []byte {
+	g.RLock()
+	defer g.RUnlock()
+	var digest []byte
+	for v := range g.state {
+		digest = append(digest, v)
+	}
+	return digest
+}
+
+func (g *digestGossiper) DiffFromDigest(digest []byte) GossipData {
+	g.RLock()
+	defer g.RUnlock()
+	remote := make(map[byte]struct{})
+	for _, v := range digest {
+		remote[v] = struct{}{}
+	}
+	var diff []byte
+	for v := range g.state {
+		if _, found := remote[v]; !found {
+			diff = append(diff, v)
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return newSurrogateGossipData(diff)
+}
+
+func (g *digestGossiper) has(vs ...byte) bool {
+	g.RLock()
+	defer g.RUnlock()
+	for _, v := range vs {
+		if _, found := g.state[v]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGossipDigests(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	var gossipers []*digestGossiper
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		g := &digestGossiper{testGossiper: newTestGossiper()}
+		g.state[byte(i)] = struct{}{}
+		_, err = router.NewGossip("digest", g)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, gossipers = append(routers, router), append(gossipers, g)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+
+	// Establishing the connection prompts each end to gossip down it.
+	routers[1].ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+	waitFor(t, "state exchanged", func() bool {
+		return gossipers[0].has(1, 2) && gossipers[1].has(1, 2)
+	})
+
+	gossipers[1].Lock()
+	gossipers[1].state[3] = struct{}{}
+	gossipers[1].Unlock()
+	routers[0].gossipChannel("digest").sendGossip()
+	waitFor(t, "state pulled", func() bool {
+		return gossipers[0].has(3)
+	})
+	for _, g := range gossipers {
+		require.Zero(t, atomic.LoadInt32(&g.fullGossips), "complete state sent")
+	}
+}
@@ -0,0 +1,192 @@
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// QueryReply is a peer's reply to a query emitted with QueryGossip.GossipQuery.
+// Err is a *QueryError if the peer failed to answer.
+type QueryReply struct {
+	Peer  PeerName
+	Reply []byte
+	Err   error
+}
+
+// QueryError reports a peer's failure to answer a query.
+type QueryError struct {
+	Peer    PeerName
+	Message string
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("query of %s failed: %s", err.Peer, err.Message)
+}
+
+// A ProtocolGossipQuery msg's payload is a uvarint query ID, unique to
+// the querying peer, followed by the query. It travels from the querying
+// peer along the same trees as broadcasts, each peer relaying it before
+// answering it. A ProtocolGossipQueryReply msg's payload is the query ID,
+// a status byte and either the reply or an error message, and travels
+// back to the querying peer like a unicast. Neither is sent over
+// connections without the "Queries" feature, so peers reachable only
+// through such connections never reply.
+const (
+	queryReplyOK byte = iota
+	queryReplyError
+)
+
+// queryConnection is implemented by connections which know whether their
+// remote relays and answers queries.
+type queryConnection interface {
+	answersQueries() bool
+}
+
+func answersQueries(conn Connection) bool {
+	qc, ok := conn.(queryConnection)
+	return ok && qc.answersQueries()
+}
+
+// GossipQuery implements QueryGossip.
+func (c *gossipChannel) GossipQuery(ctx context.Context, query []byte, onReply func(QueryReply)) ([]PeerName, error) {
+	if c.closed() {
+		return nil, errGossipClosed
+	}
+	waiting := c.ourself.router.Peers.names()
+	delete(waiting, c.ourself.Name)
+
+	replies := make(chan QueryReply, len(waiting))
+	c.queryLock.Lock()
+	c.nextQueryID++
+	id := c.nextQueryID
+	c.queries[id] = replies
+	c.queryLock.Unlock()
+	defer func() {
+		c.queryLock.Lock()
+		delete(c.queries, id)
+		c.queryLock.Unlock()
+	}()
+
+	c.relayQuery(gossipMsg{channelName: c.name, srcName: c.ourself.Name, payload: makeQueryMsg(id, query)})
+	reply, err := c.answerQuery(c.ourself.Name, query)
+	onReply(QueryReply{Peer: c.ourself.Name, Reply: reply, Err: err})
+	for len(waiting) > 0 {
+		select {
+		case r := <-replies:
+			if _, found := waiting[r.Peer]; found {
+				delete(waiting, r.Peer)
+				onReply(r)
+			}
+		case <-ctx.Done():
+			missing := make([]PeerName, 0, len(waiting))
+			for name := range waiting {
+				missing = append(missing, name)
+			}
+			sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+			return missing, ctx.Err()
+		}
+	}
+	return nil, nil
+}
+
+func (c *gossipChannel) answerQuery(src PeerName, query []byte) ([]byte, error) {
+	gossiper, ok := c.gossiper.(QueryGossiper)
+	if !ok {
+		return nil, &QueryError{c.ourself.Name, "queries not supported on channel " + c.name}
+	}
+	reply, err := gossiper.OnGossipQuery(src, query)
+	if err != nil {
+		return nil, &QueryError{c.ourself.Name, err.Error()}
+	}
+	return reply, nil
+}
+
+// relayQuery sends m, a query, on to the next peers of the broadcast tree
+// rooted at its source.
+func (c *gossipChannel) relayQuery(m gossipMsg) {
+	c.routes.ensureRecalculated()
+	for _, conn := range c.ourself.ConnectionsTo(c.routes.BroadcastAll(m.srcName)) {
+		if !answersQueries(conn) {
+			continue
+		}
+		buf, err := gossipCodecFor(conn).encode(ProtocolGossipQuery, m)
+		if err == nil {
+			err = conn.(protocolSender).SendProtocolMsg(protocolMsg{ProtocolGossipQuery, buf})
+		}
+		if err != nil {
+			c.logf("unable to relay query to %s: %v", conn.Remote().Name, err)
+		}
+	}
+}
+
+// deliverQuery relays a query received from another peer, then answers it
+// in a goroutine of its own, so as not to hold up the connection it
+// arrived on.
+func (c *gossipChannel) deliverQuery(m gossipMsg) error {
+	id, n := binary.Uvarint(m.payload)
+	if n <= 0 {
+		return errMalformedGossip
+	}
+	c.relayQuery(m)
+	router := c.ourself.router
+	if !router.track() {
+		return nil // stopping
+	}
+	go func() {
+		defer router.untrack()
+		reply, err := c.answerQuery(m.srcName, m.payload[n:])
+		payload := makeQueryReply(id, queryReplyOK, reply)
+		if err != nil {
+			payload = makeQueryReply(id, queryReplyError, []byte(err.(*QueryError).Message))
+		}
+		if err := c.relayUnicast(ProtocolGossipQueryReply, gossipMsg{channelName: c.name, srcName: c.ourself.Name, dstName: m.srcName, payload: payload}); err != nil {
+			c.logf("unable to reply to query from %s: %v", m.srcName, err)
+		}
+	}()
+	return nil
+}
+
+// deliverQueryReply passes a reply to the query it answers, if ours and
+// still awaiting replies, or relays it on towards its destination.
+func (c *gossipChannel) deliverQueryReply(m gossipMsg) error {
+	if c.ourself.Name != m.dstName {
+		if err := c.relayUnicast(ProtocolGossipQueryReply, m); err != nil {
+			c.logf("%v", err)
+		}
+		return nil
+	}
+	id, n := binary.Uvarint(m.payload)
+	if n <= 0 || len(m.payload) < n+1 {
+		return errMalformedGossip
+	}
+	r := QueryReply{Peer: m.srcName}
+	switch status, body := m.payload[n], m.payload[n+1:]; status {
+	case queryReplyOK:
+		r.Reply = body
+	case queryReplyError:
+		r.Err = &QueryError{m.srcName, string(body)}
+	default:
+		return fmt.Errorf("unknown query reply status %d from %s", status, m.srcName)
+	}
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	if replies, found := c.queries[id]; found { // otherwise the querier gave up
+		select {
+		case replies <- r:
+		default: // full of duplicates
+		}
+	}
+	return nil
+}
+
+func makeQueryMsg(id uint64, query []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(query))
+	n := binary.PutUvarint(buf, id)
+	return append(buf[:n], query...)
+}
+
+func makeQueryReply(id uint64, status byte, body []byte) []byte {
+	return append(makeQueryMsg(id, []byte{status}), body...)
+}
@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type queryGossiper struct {
+	*testGossiper
+	name PeerName
+}
+
+func (g *queryGossiper) OnGossipQuery(src PeerName, query []byte) ([]byte, error) {
+	switch string(query) {
+	case "fail":
+		return nil, fmt.Errorf("failed as asked")
+	case "hang":
+		if src != g.name {
+			time.Sleep(time.Second)
+		}
+	}
+	return []byte(fmt.Sprintf("%s from %s to %s", query, src, g.name)), nil
+}
+
+func TestGossipQuery(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	var channels []QueryGossip
+	for i := 1; i <= 4; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		var gossiper Gossiper = &queryGossiper{newTestGossiper(), name}
+		if i == 3 {
+			gossiper = newTestGossiper() // unable to answer
+		}
+		channel, err := router.NewGossip("query", gossiper)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, channels = append(routers, router), append(channels, channel.(QueryGossip))
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+
+	// A line, so that the query and replies are relayed.
+	for i := 1; i < len(routers); i++ {
+		routers[i].ConnectionMaker.InitiateConnections([]string{routers[i-1].Addr().String()}, true)
+	}
+	first, last := routers[0].Ourself.Name, routers[3].Ourself.Name
+	waitFor(t, "routes", func() bool {
+		// Replies are unicast back to the first.
+		for _, router := range routers[1:] {
+			if _, found := router.Routes.UnicastAll(first); !found {
+				return false
+			}
+		}
+		_, found := routers[0].Routes.UnicastAll(last)
+		return found && len(routers[3].Routes.BroadcastAll(first)) == 0 &&
+			len(routers[2].Routes.BroadcastAll(first)) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replies := make(map[PeerName]QueryReply)
+	missing, err := channels[0].GossipQuery(ctx, []byte("hello"), func(r QueryReply) {
+		_, duplicate := replies[r.Peer]
+		require.False(t, duplicate)
+		replies[r.Peer] = r
+	})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Len(t, replies, 4)
+	for i, router := range routers {
+		r := replies[router.Ourself.Name]
+		if i == 2 {
+			require.IsType(t, &QueryError{}, r.Err)
+			continue
+		}
+		require.NoError(t, r.Err)
+		require.Equal(t, fmt.Sprintf("hello from %s to %s", routers[0].Ourself.Name, router.Ourself.Name), string(r.Reply))
+	}
+
+	// Replies to queries from elsewhere find their way back.
+	replies = make(map[PeerName]QueryReply)
+	_, err = channels[3].GossipQuery(ctx, []byte("fail"), func(r QueryReply) { replies[r.Peer] = r })
+	require.NoError(t, err)
+	require.Len(t, replies, 4)
+	require.Equal(t, &QueryError{last, "failed as asked"}, replies[last].Err)
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	replies = make(map[PeerName]QueryReply)
+	missing, err = channels[0].GossipQuery(shortCtx, []byte("hang"), func(r QueryReply) { replies[r.Peer] = r })
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, []PeerName{routers[1].Ourself.Name, last}, missing)
+	require.Len(t, replies, 2) // ourself and the peer unable to answer
+}
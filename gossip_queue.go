@@ -0,0 +1,206 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// GossipQueuePolicy says what becomes of gossip for a connection whose
+// queue of gossip yet to be sent is full, per GossipConfig.QueueBytes or
+// Config.GossipQueueBytes.
+type GossipQueuePolicy int
+
+const (
+	// GossipDropNewest discards the gossip being queued.
+	GossipDropNewest GossipQueuePolicy = iota
+	// GossipDropOldest discards the channel's oldest queued gossip to
+	// make room, a source's broadcasts or else the rest of its gossip at a
+	// time, failing which the gossip being queued.
+	GossipDropOldest
+	// GossipBlock waits for the queue to drain, when the gossip is emitted
+	// by the application with GossipBroadcast or GossipNeighbourSubset,
+	// which must then not be called from within a Gossiper. Other gossip,
+	// e.g. that relayed from other peers, which must not hold up the
+	// connection it arrived on, is discarded instead.
+	GossipBlock
+	// GossipDisconnect discards the gossip being queued, and shuts down
+	// the connection to the slow peer.
+	GossipDisconnect
+)
+
+// gossipQueue accounts for the gossip queued for a connection across all
+// its channels, and for what was dropped. Gossip is measured by the size
+// of its encoding when queued, regardless of any merging, and only when
+// there is a limit to enforce. Topology gossip, without which the mesh
+// cannot route, is exempt from limits.
+type gossipQueue struct {
+	queued       int64  // bytes; accessed atomically
+	droppedBytes uint64 // accessed atomically
+	drops        uint64 // GossipData discarded; accessed atomically
+	limit        int64  // zero for none
+
+	sync.Mutex
+	drained chan struct{} // closed, and replaced, whenever gossip leaves the queue
+}
+
+var errGossipQueueFull = fmt.Errorf("gossip queue full")
+
+func newGossipQueue(limit int) *gossipQueue {
+	return &gossipQueue{limit: int64(limit), drained: make(chan struct{})}
+}
+
+func (q *gossipQueue) full(size int) bool {
+	queued := atomic.LoadInt64(&q.queued)
+	return q.limit > 0 && queued > 0 && queued+int64(size) > q.limit
+}
+
+func (q *gossipQueue) add(size int) {
+	atomic.AddInt64(&q.queued, int64(size))
+}
+
+func (q *gossipQueue) remove(size int) {
+	if size == 0 {
+		return
+	}
+	atomic.AddInt64(&q.queued, -int64(size))
+	q.Lock()
+	close(q.drained)
+	q.drained = make(chan struct{})
+	q.Unlock()
+}
+
+func (q *gossipQueue) drainedChan() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+	return q.drained
+}
+
+func (q *gossipQueue) dropped(size, drops int) {
+	atomic.AddUint64(&q.droppedBytes, uint64(size))
+	atomic.AddUint64(&q.drops, uint64(drops))
+}
+
+func (q *gossipQueue) droppedStats() (bytes, drops uint64) {
+	return atomic.LoadUint64(&q.droppedBytes), atomic.LoadUint64(&q.drops)
+}
+
+// size returns the size of data for the purpose of enforcing limits, or
+// zero if the channel's senders have none. It is measured once for all
+// the senders data is queued on.
+func (c *gossipChannel) size(data GossipData) int {
+	if c.priority == gossipPriorityTopology || (c.queueLimit == 0 && c.ourself.router.GossipQueueBytes <= 0) {
+		return 0
+	}
+	if sizer, ok := data.(GossipDataSizer); ok {
+		return sizer.Size()
+	}
+	size := 0
+	for _, msg := range data.Encode() {
+		size += len(msg)
+	}
+	return size
+}
+
+// makeRoom makes room to queue size bytes, as the policy dictates,
+// reporting whether it did. It waits only if block is set, which it must
+// not be in a connection's goroutines. Must hold the lock.
+func (s *gossipSender) makeRoom(size int, block bool) bool {
+	for s.full(size) {
+		switch s.policy {
+		case GossipDropOldest:
+			if dropped := s.dropOldest(); dropped > 0 {
+				s.queue.dropped(dropped, 1)
+				continue
+			}
+		case GossipBlock:
+			if block && s.waitForRoom(size) {
+				continue
+			}
+		case GossipDisconnect:
+			if conn, ok := s.sender.(interface{ shutdown(error) }); ok {
+				conn.shutdown(errGossipQueueFull)
+			}
+		}
+		s.queue.dropped(size, 1)
+		return false
+	}
+	return true
+}
+
+func (s *gossipSender) full(size int) bool {
+	if s.priority == gossipPriorityTopology {
+		return false
+	}
+	return (s.limit > 0 && s.queued > 0 && s.queued+size > s.limit) || s.queue.full(size)
+}
+
+// waitForRoom waits for gossip to leave the connection's queue, if there
+// is still no room for size bytes, reporting false if the sender finishes
+// first. Must hold the lock, which is released while waiting.
+func (s *gossipSender) waitForRoom(size int) bool {
+	drained := s.queue.drainedChan()
+	if !s.full(size) {
+		return true
+	}
+	s.Unlock()
+	defer s.Lock()
+	select {
+	case <-drained:
+		return true
+	case <-s.finished:
+		return false
+	}
+}
+
+// dropOldest discards the queued gossip, or broadcasts of one source,
+// queued first, returning its size. Must hold the lock.
+func (s *gossipSender) dropOldest() int {
+	var oldest PeerName
+	oldestSeq, found := s.gossipSeq, s.gossip != nil
+	for srcName, seq := range s.broadcastSeqs {
+		if !found || seq < oldestSeq {
+			oldest, oldestSeq, found = srcName, seq, true
+		}
+	}
+	switch {
+	case !found:
+		return 0
+	case s.gossip != nil && oldestSeq == s.gossipSeq:
+		size := s.gossipSize
+		s.gossip = nil
+		s.gossipSize = 0
+		s.dequeued(size)
+		return size
+	}
+	size := s.broadcastSizes[oldest]
+	s.removeBroadcast(oldest)
+	s.dequeued(size)
+	return size
+}
+
+// discard empties the queue, returning the number of GossipData
+// discarded. Must hold the lock.
+func (s *gossipSender) discard() int {
+	discarded := len(s.broadcasts)
+	if s.gossip != nil {
+		discarded++
+	}
+	s.gossip = nil
+	s.broadcasts = make(map[PeerName]GossipData)
+	s.broadcastSizes = make(map[PeerName]int)
+	s.broadcastSeqs = make(map[PeerName]uint64)
+	s.dequeued(s.queued)
+	s.gossipSize = 0
+	return discarded
+}
+
+func (s *gossipSender) enqueued(size int) {
+	s.queued += size
+	s.queue.add(size)
+}
+
+func (s *gossipSender) dequeued(size int) {
+	s.queued -= size
+	s.queue.remove(size)
+}
@@ -0,0 +1,130 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedSender records the msgs it sends, each only once let through.
+type gatedSender struct {
+	gate      chan struct{}
+	sent      chan string
+	shutdowns chan error
+}
+
+func (s *gatedSender) SendProtocolMsg(m protocolMsg) error {
+	<-s.gate
+	s.sent <- string(m.msg)
+	return nil
+}
+
+func (s *gatedSender) shutdown(err error) {
+	s.shutdowns <- err
+}
+
+func TestGossipQueuePolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy  GossipQueuePolicy
+		sent    []string
+		dropped uint64
+	}{
+		{GossipDropNewest, []string{"first", "second"}, 6},
+		{GossipDropOldest, []string{"first", "third_"}, 6},
+		{GossipBlock, []string{"first", "second", "third_"}, 0},
+		{GossipDisconnect, []string{"first", "second"}, 6},
+	} {
+		t.Run(fmt.Sprint(test.policy), func(t *testing.T) {
+			stop := make(chan struct{})
+			defer close(stop)
+			sender := &gatedSender{make(chan struct{}), make(chan string, 3), make(chan error, 1)}
+			makeMsg := func(msg []byte) (protocolMsg, error) { return protocolMsg{ProtocolGossip, msg}, nil }
+			queue := newGossipQueue(0)
+			s := newGossipSender(makeMsg, nil, makeMsg, sender, queue, &gossipScheduler{}, GossipPriorityNormal, 10, test.policy, stop)
+			queued := func() int {
+				s.Lock()
+				defer s.Unlock()
+				return s.queued
+			}
+			empty := func() bool {
+				s.Lock()
+				defer s.Unlock()
+				return s.empty()
+			}
+
+			// The first is sent straight away, to wait at the gate.
+			send := func(msg string) {
+				s.Send(newSurrogateGossipData([]byte(msg)), len(msg), true)
+			}
+			send("first")
+			waitFor(t, "first picked", empty)
+			send("second")
+			require.Equal(t, 6, queued())
+			third := make(chan struct{})
+			go func() {
+				send("third_")
+				close(third)
+			}()
+			if test.policy == GossipBlock {
+				select {
+				case <-third:
+					require.FailNow(t, "not blocked")
+				case <-time.After(50 * time.Millisecond):
+				}
+			} else {
+				<-third
+			}
+			if test.policy == GossipDisconnect {
+				require.Equal(t, errGossipQueueFull, <-sender.shutdowns)
+			}
+
+			close(sender.gate)
+			<-third
+			for _, expected := range test.sent {
+				require.Equal(t, expected, <-sender.sent)
+			}
+			droppedBytes, _ := queue.droppedStats()
+			require.Equal(t, test.dropped, droppedBytes)
+			waitFor(t, "queue drained", func() bool { return queued() == 0 })
+		})
+	}
+}
+
+func TestGossipQueueDropOldest(t *testing.T) {
+	// Stopped, so that nothing leaves the queue.
+	stop := make(chan struct{})
+	close(stop)
+	sender := &gatedSender{make(chan struct{}), make(chan string, 4), make(chan error, 1)}
+	makeMsg := func(msg []byte) (protocolMsg, error) { return protocolMsg{ProtocolGossip, msg}, nil }
+	makeBroadcastMsg := func(srcName PeerName, msg []byte) (protocolMsg, error) { return makeMsg(msg) }
+	s := newGossipSender(makeMsg, makeBroadcastMsg, makeMsg, sender, newGossipQueue(0), &gossipScheduler{}, GossipPriorityNormal, 12, GossipDropOldest, stop)
+	src1, _ := PeerNameFromString("01:00:00:01:00:00")
+	src2, _ := PeerNameFromString("02:00:00:02:00:00")
+
+	// Only the oldest is dropped to make room, leaving the rest.
+	s.Broadcast(src1, newSurrogateGossipData([]byte("b1")), 4, false)
+	s.Send(newSurrogateGossipData([]byte("g1")), 4, false)
+	s.Broadcast(src2, newSurrogateGossipData([]byte("b2")), 4, false)
+	s.Broadcast(src2, newSurrogateGossipData([]byte("b3")), 4, false)
+	s.Lock()
+	require.Equal(t, 12, s.queued)
+	require.Nil(t, s.broadcasts[src1], "the oldest")
+	require.NotNil(t, s.gossip)
+	s.Unlock()
+
+	// Whereas GossipBlock gives way to dropping when not to block.
+	s.policy = GossipBlock
+	s.Send(newSurrogateGossipData([]byte("g2")), 4, false)
+	s.Lock()
+	require.Equal(t, 12, s.queued)
+	s.Unlock()
+
+	// And topology gossip is never dropped.
+	s.priority = gossipPriorityTopology
+	s.Send(newSurrogateGossipData([]byte("t1")), 4, false)
+	s.Lock()
+	require.Equal(t, 16, s.queued)
+	s.Unlock()
+}
@@ -0,0 +1,137 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+)
+
+// GossipPriority is the class of a gossip channel, per GossipConfig. The
+// gossip of the channels on a connection is sent one frame at a time, so
+// that a large msg sent in chunks takes a turn per chunk, with each class that has gossip waiting getting turns in
+// proportion to its weight: 16 for high, 4 for normal and 1 for bulk.
+// Channels of the same class take turns. Topology gossip always goes
+// first, and heartbeats and unicasts, which are not queued, do not wait
+// for turns at all.
+type GossipPriority int
+
+const (
+	// GossipPriorityNormal is the class of most channels.
+	GossipPriorityNormal GossipPriority = iota
+	// GossipPriorityHigh is for latency-sensitive channels.
+	GossipPriorityHigh
+	// GossipPriorityBulk is for channels which can wait.
+	GossipPriorityBulk
+	// gossipPriorityTopology is for the topology channel only.
+	gossipPriorityTopology
+	numGossipPriorities
+)
+
+var gossipPriorityWeights = [numGossipPriorities]int{
+	GossipPriorityNormal: 4,
+	GossipPriorityHigh:   16,
+	GossipPriorityBulk:   1,
+}
+
+// gossipScheduler hands out turns to send on a connection, to the
+// gossipSenders of its channels. Among the classes with senders waiting,
+// turns go to topology first, and otherwise by smooth weighted round-robin.
+type gossipScheduler struct {
+	sync.Mutex
+	busy    bool // whether a turn is in progress
+	waiting [numGossipPriorities][]chan struct{}
+	current [numGossipPriorities]int // for weighted round-robin
+}
+
+// acquire waits for a turn for a sender of the priority class, reporting
+// false if stop, for the connection, or quit, for the sender, is closed
+// first. Every successful acquire must be followed by release.
+func (s *gossipScheduler) acquire(priority GossipPriority, stop, quit <-chan struct{}) bool {
+	s.Lock()
+	if !s.busy {
+		s.busy = true
+		s.Unlock()
+		return true
+	}
+	turn := make(chan struct{})
+	s.waiting[priority] = append(s.waiting[priority], turn)
+	s.Unlock()
+
+	select {
+	case <-turn:
+		return true
+	case <-stop:
+	case <-quit:
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i, t := range s.waiting[priority] {
+		if t == turn {
+			s.waiting[priority] = append(s.waiting[priority][:i], s.waiting[priority][i+1:]...)
+			return false
+		}
+	}
+	// Given the turn regardless, so pass it on.
+	s.handOver()
+	return false
+}
+
+// release ends a turn, handing over to the next waiting sender.
+func (s *gossipScheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.handOver()
+}
+
+// gossipTurns takes the turns of a sender of the priority class.
+type gossipTurns struct {
+	scheduler  *gossipScheduler
+	priority   GossipPriority
+	stop, quit <-chan struct{}
+}
+
+var errNoTurn = fmt.Errorf("gossip sender stopped while waiting for a turn")
+
+// send calls send in a turn, returning errNoTurn if not given one, or
+// straight away if t is nil.
+func (t *gossipTurns) send(send func() error) error {
+	if t == nil {
+		return send()
+	}
+	if !t.scheduler.acquire(t.priority, t.stop, t.quit) {
+		return errNoTurn
+	}
+	defer t.scheduler.release()
+	return send()
+}
+
+// handOver gives the next turn to the sender due it, if any. Must hold
+// the lock.
+func (s *gossipScheduler) handOver() {
+	next := GossipPriority(-1)
+	if len(s.waiting[gossipPriorityTopology]) > 0 {
+		next = gossipPriorityTopology
+	} else {
+		total := 0
+		for priority, weight := range gossipPriorityWeights {
+			if weight == 0 || len(s.waiting[priority]) == 0 {
+				s.current[priority] = 0
+				continue
+			}
+			total += weight
+			s.current[priority] += weight
+			if next < 0 || s.current[priority] > s.current[next] {
+				next = GossipPriority(priority)
+			}
+		}
+		if next >= 0 {
+			s.current[next] -= total
+		}
+	}
+	if next < 0 {
+		s.busy = false
+		return
+	}
+	turn := s.waiting[next][0]
+	s.waiting[next] = s.waiting[next][1:]
+	close(turn)
+}
@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipScheduler(t *testing.T) {
+	s := &gossipScheduler{}
+	stop := make(chan struct{})
+	defer close(stop)
+	require.True(t, s.acquire(GossipPriorityNormal, stop, nil))
+
+	granted := make(chan GossipPriority)
+	wait := func(priority GossipPriority, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				if s.acquire(priority, stop, nil) {
+					granted <- priority
+				}
+			}()
+		}
+		waitFor(t, "waiting", func() bool {
+			s.Lock()
+			defer s.Unlock()
+			return len(s.waiting[priority]) == n
+		})
+	}
+	wait(GossipPriorityBulk, 30)
+	wait(GossipPriorityNormal, 30)
+	wait(GossipPriorityHigh, 30)
+	wait(gossipPriorityTopology, 1)
+
+	next := func() GossipPriority {
+		s.release()
+		return <-granted
+	}
+	require.Equal(t, gossipPriorityTopology, next())
+	counts := make(map[GossipPriority]int)
+	for i := 0; i < 21; i++ {
+		counts[next()]++
+	}
+	require.Equal(t, map[GossipPriority]int{GossipPriorityHigh: 16, GossipPriorityNormal: 4, GossipPriorityBulk: 1}, counts)
+
+	// A waiter giving up, whether its connection or just its sender
+	// stops, leaves the others be.
+	for _, connection := range []bool{true, false} {
+		giveUp := make(chan struct{})
+		gaveUp := make(chan bool)
+		go func() {
+			if connection {
+				gaveUp <- s.acquire(GossipPriorityHigh, giveUp, nil)
+			} else {
+				gaveUp <- s.acquire(GossipPriorityHigh, stop, giveUp)
+			}
+		}()
+		waitFor(t, "waiting", func() bool {
+			s.Lock()
+			defer s.Unlock()
+			return len(s.waiting[GossipPriorityHigh]) == 15
+		})
+		close(giveUp)
+		require.False(t, <-gaveUp)
+	}
+	require.Equal(t, GossipPriorityHigh, next())
+}
+
+// gatedFrames is a tcpSender recording the tag of each frame it sends,
+// each only once let through.
+type gatedFrames struct {
+	gate chan struct{}
+	sent chan byte
+}
+
+func (s *gatedFrames) Send(frame []byte) error {
+	<-s.gate
+	s.sent <- frame[0]
+	return nil
+}
+
+func TestGossipSchedulerChunks(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	frames := &gatedFrames{make(chan struct{}), make(chan byte, 8)}
+	conn := &LocalConnection{tcpSender: frames, chunking: true, maxMessageSize: 4 * chunkSize}
+	conn.senders = newGossipSenders(conn, 0, stop)
+	makeMsg := func(msg []byte) (protocolMsg, error) { return protocolMsg{ProtocolGossip, msg}, nil }
+	newSender := func(priority GossipPriority) *gossipSender {
+		return newGossipSender(makeMsg, nil, makeMsg, conn, conn.senders.queue, conn.senders.scheduler, priority, 0, GossipDropNewest, stop)
+	}
+	bulk, high := newSender(GossipPriorityBulk), newSender(GossipPriorityHigh)
+
+	// A bulk msg of three chunks is in flight...
+	bulk.Send(newSurrogateGossipData(make([]byte, 2*chunkSize+1)), 0, false)
+	scheduler := conn.senders.scheduler
+	waitFor(t, "bulk msg sending", func() bool {
+		scheduler.Lock()
+		defer scheduler.Unlock()
+		return scheduler.busy
+	})
+	// ...when high priority gossip comes along, and goes after its first
+	// chunk.
+	high.Send(newSurrogateGossipData([]byte("urgent")), 0, false)
+	waitFor(t, "waiting", func() bool {
+		scheduler.Lock()
+		defer scheduler.Unlock()
+		return len(scheduler.waiting[GossipPriorityHigh]) == 1
+	})
+	close(frames.gate)
+	for _, tag := range []byte{ProtocolChunk, ProtocolGossip, ProtocolChunk, ProtocolChunk} {
+		require.Equal(t, tag, <-frames.sent)
+	}
+}
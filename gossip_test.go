@@ -1,12 +1,12 @@
 package mesh
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"math"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,9 +25,9 @@ var _ gossipConnection = &mockGossipConnection{}
 
 func newTestRouter(t *testing.T, name string) *Router {
 	peerName, _ := PeerNameFromString(name)
-	router, err := NewRouter(Config{}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	router, err := NewRouter(Config{}, peerName, "nick", nil)
 	require.NoError(t, err)
-	router.Start()
+	require.NoError(t, router.Start())
 	return router
 }
 
@@ -48,7 +48,7 @@ func (conn *mockGossipConnection) logf(format string, args ...interface{}) {
 
 func (conn *mockGossipConnection) SendProtocolMsg(pm protocolMsg) error {
 	<-conn.start
-	return conn.dest.handleGossip(pm.tag, pm.msg)
+	return conn.dest.handleGossip(gobGossipCodec{}, pm.tag, pm.msg)
 }
 
 func (conn *mockGossipConnection) gossipSenders() *gossipSenders {
@@ -97,7 +97,7 @@ func (router *Router) newTestGossipConnection(t require.TestingT, r *Router) *mo
 		dest:             r,
 		start:            make(chan struct{}),
 	}
-	conn.senders = newGossipSenders(conn, make(chan struct{}))
+	conn.senders = newGossipSenders(conn, 0, make(chan struct{}))
 	require.NoError(t, router.Ourself.handleAddConnection(conn, false))
 	router.Ourself.handleConnectionEstablished(conn)
 	return conn
@@ -204,8 +204,8 @@ func TestGossipSurrogate(t *testing.T) {
 
 	// check that each end gets their message back through periodic
 	// gossip
-	r1.sendAllGossip()
-	r3.sendAllGossip()
+	r1.gossipChannel("Test").sendGossip()
+	r3.gossipChannel("Test").sendGossip()
 	sendPendingGossip(r1, r2, r3)
 	g1.checkHas(t, 1, 2)
 	g3.checkHas(t, 1, 2)
@@ -293,7 +293,7 @@ func TestRandomNeighbours(t *testing.T) {
 			counts := make([]int, test.nNeighbours+1)
 			// Run randomNeighbours() several times, and count the distribution
 			for trial := 0; trial < nTrials; trial++ {
-				targets := r.randomNeighbours(ourself)
+				targets := r.randomNeighbours(ourself, 0)
 				expected := int(math.Min(2*math.Log2(float64(test.nPeers)), float64(test.nNeighbours)))
 				require.Equal(t, expected, len(targets))
 				total += len(targets)
@@ -306,6 +306,120 @@ func TestRandomNeighbours(t *testing.T) {
 			for i := 1; i < test.nNeighbours+1; i++ {
 				require.InEpsilon(t, float64(total)/float64(test.nNeighbours), counts[i], 0.2, "peer %d picked %d times out of %d; counts %v", i, counts[i], total, counts)
 			}
+			require.Len(t, r.randomNeighbours(ourself, 1), int(math.Min(1, float64(test.nNeighbours))), "fanout")
 		})
 	}
 }
+
+func TestGossipChannelConfig(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	var fast, off []*testGossiper
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		f, o := newTestGossiper(), newTestGossiper()
+		_, err = router.NewGossipWithConfig("fast", f, GossipConfig{Interval: 10 * time.Millisecond, Fanout: 1})
+		require.NoError(t, err)
+		_, err = router.NewGossipWithConfig("off", o, GossipConfig{NoPeriodicGossip: true})
+		require.NoError(t, err)
+		_, err = router.NewGossipWithConfig("topological", o, GossipConfig{Priority: gossipPriorityTopology})
+		require.Error(t, err, "the topology class is reserved")
+		require.NoError(t, router.Start())
+		routers, fast, off = append(routers, router), append(fast, f), append(off, o)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	routers[1].ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+	waitFor(t, "connection", func() bool {
+		return len(routers[0].Routes.BroadcastAll(routers[0].Ourself.Name)) == 1
+	})
+
+	// Added to state after the connection, so known only to periodic gossip.
+	for _, g := range []*testGossiper{fast[0], off[0]} {
+		g.Lock()
+		g.state[1] = struct{}{}
+		g.Unlock()
+	}
+	waitFor(t, "periodic gossip", func() bool {
+		fast[1].RLock()
+		defer fast[1].RUnlock()
+		_, found := fast[1].state[1]
+		return found
+	})
+	off[1].RLock()
+	defer off[1].RUnlock()
+	require.Empty(t, off[1].state)
+}
+
+func TestCloseGossip(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	var gossips []Gossip
+	var gossipers []*testGossiper
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		g := newTestGossiper()
+		gossip, err := router.NewGossip("closing", g)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, gossips, gossipers = append(routers, router), append(gossips, gossip), append(gossipers, g)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	routers[1].ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+	waitFor(t, "connection", func() bool {
+		return len(routers[0].Routes.BroadcastAll(routers[0].Ourself.Name)) == 1
+	})
+	hasChannel := func(router *Router) bool {
+		router.gossipLock.RLock()
+		defer router.gossipLock.RUnlock()
+		_, found := router.gossipChannels["closing"]
+		return found
+	}
+
+	require.Error(t, routers[1].CloseGossip("unknown", false))
+	require.Error(t, routers[1].CloseGossip("topology", false))
+
+	broadcast(gossips[0], 1)
+	waitFor(t, "broadcast", func() bool {
+		gossipers[1].RLock()
+		defer gossipers[1].RUnlock()
+		_, found := gossipers[1].state[1]
+		return found
+	})
+	require.NoError(t, routers[1].CloseGossip("closing", false))
+	require.False(t, hasChannel(routers[1]))
+	for conn := range routers[1].Ourself.getConnections() {
+		senders := conn.(gossipConnection).gossipSenders()
+		senders.Lock()
+		_, found := senders.senders["closing"]
+		senders.Unlock()
+		require.False(t, found, "sender left behind")
+	}
+	require.Equal(t, errGossipClosed, gossips[1].GossipUnicast(routers[0].Ourself.Name, nil))
+
+	broadcast(gossips[0], 2)
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, hasChannel(routers[1]), "recreated as surrogate")
+	gossipers[1].RLock()
+	require.NotContains(t, gossipers[1].state, byte(2))
+	gossipers[1].RUnlock()
+
+	_, err := routers[1].NewGossip("closing", newTestGossiper())
+	require.NoError(t, err)
+	require.NoError(t, routers[1].CloseGossip("closing", true))
+	broadcast(gossips[0], 3)
+	waitFor(t, "surrogate", func() bool { return hasChannel(routers[1]) })
+}
@@ -3,7 +3,6 @@ package mesh
 import (
 	"encoding/gob"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 )
@@ -22,6 +21,8 @@ type localPeer struct {
 	topologyUpdates       peerNameSet
 	timer                 *time.Timer
 	pendingTopologyUpdate bool
+	quit                  chan struct{}
+	finished              chan struct{} // closed to signal that actorLoop has finished
 }
 
 // The actor closure used by localPeer.
@@ -37,7 +38,10 @@ func newLocalPeer(name PeerName, nickName string, router *Router) *localPeer {
 		actionChan:      actionChan,
 		topologyUpdates: topologyUpdates,
 		timer:           time.NewTimer(deferTopologyUpdateDuration),
+		quit:            make(chan struct{}),
+		finished:        make(chan struct{}),
 	}
+	peer.WeightedRoutes = true
 	peer.timer.Stop()
 	go peer.actorLoop(actionChan)
 	return peer
@@ -93,20 +97,12 @@ func (peer *localPeer) createConnection(localAddr string, peerAddr string, accep
 	if err := peer.checkConnectionLimit(); err != nil {
 		return err
 	}
-	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
-	if err != nil {
-		return err
-	}
-	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", peerAddr)
-	if err != nil {
-		return err
-	}
-	tcpConn, err := net.DialTCP("tcp", localTCPAddr, remoteTCPAddr)
+	netConn, err := peer.router.transport().Dial(localAddr, peerAddr)
 	if err != nil {
 		return err
 	}
 	connRemote := newRemoteConnection(peer.Peer, nil, peerAddr, true, false)
-	startLocalConnection(connRemote, tcpConn, peer.router, acceptNewPeer)
+	startLocalConnection(connRemote, netConn, peer.router, acceptNewPeer)
 	return nil
 }
 
@@ -144,22 +140,25 @@ func (peer *localPeer) encode(enc *gob.Encoder) {
 	peer.Peer.encode(enc)
 }
 
+// Synchronous. Terminates the actor; no further actions may be sent.
+func (peer *localPeer) stop() {
+	close(peer.quit)
+	<-peer.finished
+}
+
 // ACTOR server
 
 func (peer *localPeer) actorLoop(actionChan <-chan localPeerAction) {
-	gossipInterval := defaultGossipInterval
-	if peer.router != nil {
-		gossipInterval = peer.router.gossipInterval()
-	}
-	gossipTimer := time.Tick(gossipInterval)
+	defer close(peer.finished)
 	for {
 		select {
 		case action := <-actionChan:
 			action()
-		case <-gossipTimer:
-			peer.router.sendAllGossip()
 		case <-peer.timer.C:
 			peer.broadcastPendingTopologyUpdates()
+		case <-peer.quit:
+			peer.timer.Stop()
+			return
 		}
 	}
 }
@@ -233,6 +232,7 @@ func (peer *localPeer) handleConnectionEstablished(conn ourConnection) {
 	}
 	peer.connectionEstablished(conn)
 	conn.logf("connection fully established")
+	peer.router.publishConnection(ConnectionEstablished, conn)
 
 	peer.router.Routes.recalculate()
 	peer.broadcastPeerUpdate()
@@ -251,6 +251,9 @@ func (peer *localPeer) handleDeleteConnection(conn ourConnection) {
 	}
 	peer.deleteConnection(conn)
 	conn.logf("connection deleted")
+	if conn.isEstablished() {
+		peer.router.publishConnection(ConnectionLost, conn)
+	}
 	// Must do garbage collection first to ensure we don't send out an
 	// update with unreachable peers (can cause looping)
 	peer.router.Peers.GarbageCollect()
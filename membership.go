@@ -0,0 +1,159 @@
+package mesh
+
+import "sync"
+
+// MembershipEventType is the kind of a MembershipEvent.
+type MembershipEventType int
+
+const (
+	// PeerJoined is when we learn of a peer.
+	PeerJoined MembershipEventType = iota
+	// PeerLeft is when a peer which has become unreachable is GC'd.
+	PeerLeft
+	// PeerRestarted is when we learn a peer has a new UID.
+	PeerRestarted
+	// ConnectionEstablished is when one of our connections is
+	// established.
+	ConnectionEstablished
+	// ConnectionLost is when one of our established connections is
+	// deleted.
+	ConnectionLost
+	// RoutesChanged is when our routes change.
+	RoutesChanged
+)
+
+func (t MembershipEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "PeerJoined"
+	case PeerLeft:
+		return "PeerLeft"
+	case PeerRestarted:
+		return "PeerRestarted"
+	case ConnectionEstablished:
+		return "ConnectionEstablished"
+	case ConnectionLost:
+		return "ConnectionLost"
+	case RoutesChanged:
+		return "RoutesChanged"
+	}
+	return "unknown"
+}
+
+// MembershipEvent is a change to the membership of the mesh, as seen by a
+// Router.
+type MembershipEvent struct {
+	Type MembershipEventType
+	// The peer, or the remote of the connection. Zero for RoutesChanged.
+	Peer PeerName
+	// The peer's UID, for peer events.
+	UID PeerUID
+	// The remote's address, and whether we made the connection, for
+	// connection events.
+	RemoteTCPAddr string
+	Outbound      bool
+}
+
+// Subscription delivers membership events from a Router, in the order
+// they happened, on C. Events queue for as long as the subscriber takes
+// to receive them, so it never holds up the Router.
+type Subscription struct {
+	C <-chan MembershipEvent
+
+	router *Router
+	sync.Mutex
+	queue  []MembershipEvent
+	more   chan struct{} // signalled when events are queued
+	quit   chan struct{} // closed by Close
+	closed bool
+}
+
+// Subscribe returns a new subscription to membership events from now on.
+// It must be closed when no longer wanted. C is closed once the
+// subscription is closed or the router is stopped.
+func (router *Router) Subscribe() *Subscription {
+	c := make(chan MembershipEvent)
+	s := &Subscription{C: c, router: router, more: make(chan struct{}, 1), quit: make(chan struct{})}
+	router.subscriptionsLock.Lock()
+	router.subscriptions[s] = struct{}{}
+	router.subscriptionsLock.Unlock()
+	if !router.track() {
+		s.Close()
+		close(c)
+		return s
+	}
+	go s.run(c)
+	return s
+}
+
+// Close ends the subscription. Events still queued are discarded.
+func (s *Subscription) Close() {
+	s.router.subscriptionsLock.Lock()
+	delete(s.router.subscriptions, s)
+	s.router.subscriptionsLock.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.queue = nil
+		close(s.quit)
+	}
+}
+
+func (s *Subscription) push(event MembershipEvent) {
+	s.Lock()
+	if !s.closed {
+		s.queue = append(s.queue, event)
+	}
+	s.Unlock()
+	select {
+	case s.more <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) run(c chan<- MembershipEvent) {
+	defer s.router.untrack()
+	defer close(c)
+	defer s.Close()
+	for {
+		s.Lock()
+		events := s.queue
+		s.queue = nil
+		s.Unlock()
+		for _, event := range events {
+			select {
+			case c <- event:
+			case <-s.quit:
+				return
+			case <-s.router.quit:
+				return
+			}
+		}
+		select {
+		case <-s.more:
+		case <-s.quit:
+			return
+		case <-s.router.quit:
+			return
+		}
+	}
+}
+
+// publish queues event for all current subscribers, without blocking.
+func (router *Router) publish(event MembershipEvent) {
+	router.subscriptionsLock.Lock()
+	defer router.subscriptionsLock.Unlock()
+	for s := range router.subscriptions {
+		s.push(event)
+	}
+}
+
+func (router *Router) publishConnection(eventType MembershipEventType, conn Connection) {
+	router.publish(MembershipEvent{
+		Type:          eventType,
+		Peer:          conn.Remote().Name,
+		RemoteTCPAddr: conn.remoteTCPAddress(),
+		Outbound:      conn.isOutbound(),
+	})
+}
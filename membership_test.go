@@ -0,0 +1,86 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// nextEvent returns the next event from sub of any of the types, skipping
+// others.
+func nextEvent(t *testing.T, sub *Subscription, types ...MembershipEventType) MembershipEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-sub.C:
+			require.True(t, ok, "subscription closed")
+			for _, eventType := range types {
+				if event.Type == eventType {
+					return event
+				}
+			}
+		case <-timeout:
+			require.FailNow(t, fmt.Sprint("timed out waiting for ", types))
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers = append(routers, router)
+	}
+	defer routers[0].Stop(context.Background())
+
+	sub := routers[0].Subscribe()
+	defer sub.Close()
+	// Never received from, so must not hold up the router.
+	idle := routers[0].Subscribe()
+	defer idle.Close()
+
+	routers[0].ConnectionMaker.InitiateConnections([]string{routers[1].Addr().String()}, true)
+	event := nextEvent(t, sub, PeerJoined)
+	require.Equal(t, routers[1].Ourself.Name, event.Peer)
+	require.Equal(t, routers[1].Ourself.UID, event.UID)
+	event = nextEvent(t, sub, ConnectionEstablished)
+	require.Equal(t, routers[1].Ourself.Name, event.Peer)
+	require.True(t, event.Outbound)
+	nextEvent(t, sub, RoutesChanged)
+	waitFor(t, "route", func() bool {
+		_, found := routers[0].Routes.Unicast(routers[1].Ourself.Name)
+		return found
+	})
+
+	// Lazily calculated broadcast routes do not count as changes.
+	unchanged := routers[0].Subscribe()
+	defer unchanged.Close()
+	routers[0].Routes.BroadcastAll(routers[1].Ourself.Name)
+	routers[0].Routes.recalculate()
+	routers[0].Routes.ensureRecalculated()
+	select {
+	case event := <-unchanged.C:
+		require.NotEqual(t, RoutesChanged, event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, routers[1].Stop(context.Background()))
+	event = nextEvent(t, sub, ConnectionLost)
+	require.Equal(t, routers[1].Ourself.Name, event.Peer)
+	event = nextEvent(t, sub, PeerLeft)
+	require.Equal(t, routers[1].Ourself.Name, event.Peer)
+
+	sub.Close()
+	waitFor(t, "subscription closed", func() bool {
+		_, ok := <-sub.C
+		return !ok
+	})
+}
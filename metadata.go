@@ -0,0 +1,103 @@
+package mesh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Every peer has metadata: tags such as its zone, role, build version or
+// service endpoints, set on Router.Ourself. Metadata is gossiped along
+// with the rest of the topology, so it should be kept small.
+
+// SetMetadata sets the value of one of our metadata tags.
+func (peer *localPeer) SetMetadata(key, value string) {
+	peer.updateMetadata(func(metadata map[string]string) bool {
+		if existing, found := metadata[key]; found && existing == value {
+			return false
+		}
+		metadata[key] = value
+		return true
+	})
+}
+
+// DeleteMetadata removes one of our metadata tags.
+func (peer *localPeer) DeleteMetadata(key string) {
+	peer.updateMetadata(func(metadata map[string]string) bool {
+		if _, found := metadata[key]; !found {
+			return false
+		}
+		delete(metadata, key)
+		return true
+	})
+}
+
+// updateMetadata replaces our metadata with an updated copy, which must
+// be done holding the lock on Peers as well as our own, since Peers reads
+// the metadata of every peer under its own lock. Only if update reports
+// a change is our version bumped and the update broadcast.
+func (peer *localPeer) updateMetadata(update func(map[string]string) bool) {
+	peers := peer.router.Peers
+	peers.Lock()
+	peer.Lock()
+	metadata := copyMetadata(peer.Metadata)
+	changed := update(metadata)
+	if changed {
+		peer.Metadata = metadata
+		peer.Version++
+	}
+	peer.Unlock()
+	peers.Unlock()
+	if changed {
+		peer.broadcastPeerUpdate()
+	}
+}
+
+// copyMetadata returns a copy of metadata, for callers free to modify it.
+func copyMetadata(metadata map[string]string) map[string]string {
+	copied := make(map[string]string, len(metadata)+1)
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Select returns descriptions of the known peers, ourself included, whose
+// metadata has every tag of selector with the same value. See
+// ParseSelector.
+func (peers *Peers) Select(selector map[string]string) []PeerDescription {
+	peers.RLock()
+	defer peers.RUnlock()
+	var descriptions []PeerDescription
+	for _, peer := range peers.byName {
+		if matchesSelector(peer.Metadata, selector) {
+			descriptions = append(descriptions, peers.describe(peer))
+		}
+	}
+	return descriptions
+}
+
+func matchesSelector(metadata, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, found := metadata[key]; !found || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a selector for Peers.Select written as
+// comma-separated tags, e.g. "role=ingest,zone=eu-west-1".
+func ParseSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	if s == "" {
+		return selector, nil
+	}
+	for _, tag := range strings.Split(s, ",") {
+		i := strings.Index(tag, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed selector tag %q", tag)
+		}
+		selector[strings.TrimSpace(tag[:i])] = strings.TrimSpace(tag[i+1:])
+	}
+	return selector, nil
+}
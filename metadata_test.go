@@ -0,0 +1,75 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerMetadata(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	for i := 1; i <= 3; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers = append(routers, router)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	routers[0].Ourself.SetMetadata("role", "ingest")
+	routers[0].Ourself.SetMetadata("zone", "a")
+	routers[1].Ourself.SetMetadata("role", "ingest")
+	routers[1].Ourself.SetMetadata("zone", "b")
+	routers[2].Ourself.SetMetadata("role", "query")
+	// Unchanged metadata is not gossiped again.
+	version := routers[2].Ourself.Version
+	routers[2].Ourself.SetMetadata("role", "query")
+	routers[2].Ourself.DeleteMetadata("zone")
+	require.Equal(t, version, routers[2].Ourself.Version)
+	for _, router := range routers[1:] {
+		router.ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+	}
+
+	names := func(descriptions []PeerDescription) []PeerName {
+		var names []PeerName
+		for _, description := range descriptions {
+			names = append(names, description.Name)
+		}
+		return names
+	}
+	ingest := map[string]string{"role": "ingest"}
+	waitFor(t, "metadata", func() bool {
+		return len(routers[2].Peers.Select(ingest)) == 2
+	})
+	require.ElementsMatch(t, []PeerName{routers[0].Ourself.Name, routers[1].Ourself.Name}, names(routers[2].Peers.Select(ingest)))
+	selector, err := ParseSelector("role=ingest, zone=b")
+	require.NoError(t, err)
+	require.Equal(t, []PeerName{routers[1].Ourself.Name}, names(routers[2].Peers.Select(selector)))
+	require.Len(t, routers[2].Peers.Select(nil), 3)
+
+	routers[1].Ourself.DeleteMetadata("role")
+	waitFor(t, "metadata deleted", func() bool {
+		return len(routers[2].Peers.Select(ingest)) == 1
+	})
+	for _, peer := range NewStatus(routers[2]).Peers {
+		if peer.Name == routers[1].Ourself.Name.String() {
+			require.Equal(t, map[string]string{"zone": "b"}, peer.Metadata)
+		}
+	}
+
+	// Callers get copies.
+	description := routers[1].Peers.Select(map[string]string{"zone": "b"})[0]
+	description.Metadata["zone"] = "c"
+	require.Empty(t, routers[1].Peers.Select(map[string]string{"zone": "c"}))
+
+	_, err = ParseSelector("role")
+	require.Error(t, err)
+}
@@ -1,11 +1,14 @@
 package mesh
 
 import (
+	"container/heap"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Peer is a local representation of a peer, including connections to other
@@ -15,6 +18,7 @@ type Peer struct {
 	peerSummary
 	localRefCount uint64 // maintained by Peers
 	connections   map[PeerName]Connection
+	nickNameLock  sync.RWMutex // guards NickName for String, which may be called without holding the lock on Peers
 }
 
 type peerSummary struct {
@@ -24,6 +28,10 @@ type peerSummary struct {
 	Version    uint64
 	ShortID    PeerShortID
 	HasShortID bool
+	Metadata   map[string]string // never modified, only replaced
+	// WeightedRoutes is set by peers which route unicast by
+	// weightedRoutes, rather than routes.
+	WeightedRoutes bool
 }
 
 // PeerDescription collects information about peers that is useful to clients.
@@ -33,6 +41,7 @@ type PeerDescription struct {
 	UID            PeerUID
 	Self           bool
 	NumConnections int
+	Metadata       map[string]string
 }
 
 type connectionSet map[Connection]struct{}
@@ -62,6 +71,8 @@ func newPeerPlaceholder(name PeerName) *Peer {
 
 // String returns the peer name and nickname.
 func (peer *Peer) String() string {
+	peer.nickNameLock.RLock()
+	defer peer.nickNameLock.RUnlock()
 	return fmt.Sprint(peer.Name, "(", peer.NickName, ")")
 }
 
@@ -70,9 +81,8 @@ func (peer *Peer) String() string {
 // "in order to send a message to X, the peer should send the message to its
 // neighbour Y".
 //
-// Because currently we do not have weightings on the connections between
-// peers, there is no need to use a minimum spanning tree algorithm. Instead
-// we employ the simpler and cheaper breadth-first widening. The computation
+// Connections are not weighted here, so we employ the simple and cheap
+// breadth-first widening; see weightedRoutes for unicast. The computation
 // is deterministic, which ensures that when it is performed on the same data
 // by different peers, they get the same result. This is important since
 // otherwise we risk message loss or routing cycles.
@@ -117,6 +127,100 @@ func (peer *Peer) routes(stopAt *Peer, establishedAndSymmetric bool) (bool, map[
 	return false, routes
 }
 
+// weightedRoutes is like routes, without stopAt, but finds the shortest
+// paths when each connection is weighted by the latency between its ends:
+// one, plus a unit per millisecond of the round trip time measured in
+// either direction, whichever is greater. So connections with little
+// latency between them count as hops, as for routes.
+//
+// The computation is Dijkstra's algorithm, visiting peers in order of
+// distance and then name, with the first route found to a peer kept
+// unless a strictly shorter one is found later. It is as deterministic as
+// routes, and since each hop of a shortest path leaves a shorter path
+// still to go, peers with the same data never route in cycles. That holds
+// only among peers which all route this way, so routes are weighted only
+// once every peer has WeightedRoutes; see routes.calculateUnicast.
+//
+// NB: As for routes, the caller should hold read locks on Peers and
+// LocalPeer.
+func (peer *Peer) weightedRoutes(establishedAndSymmetric bool) unicastRoutes {
+	routes := unicastRoutes{peer.Name: UnknownPeerName}
+	distances := map[PeerName]uint64{peer.Name: 0}
+	visited := make(map[PeerName]struct{})
+	queue := &routeQueue{{peer, 0}}
+	for queue.Len() > 0 {
+		cur := heap.Pop(queue).(routeCandidate)
+		if _, found := visited[cur.peer.Name]; found {
+			continue
+		}
+		visited[cur.peer.Name] = struct{}{}
+		for remoteName, conn := range cur.peer.connections {
+			if establishedAndSymmetric && !conn.isEstablished() {
+				continue
+			}
+			if _, found := visited[remoteName]; found {
+				continue
+			}
+			remotePeer := conn.Remote()
+			remoteConn, found := remotePeer.connections[cur.peer.Name]
+			if establishedAndSymmetric && !(found && remoteConn.isEstablished()) {
+				continue
+			}
+			distance := cur.distance + linkWeight(conn, remoteConn)
+			if known, found := distances[remoteName]; found && distance >= known {
+				continue
+			}
+			distances[remoteName] = distance
+			if cur.peer == peer {
+				routes[remoteName] = remoteName
+			} else {
+				routes[remoteName] = routes[cur.peer.Name]
+			}
+			heap.Push(queue, routeCandidate{remotePeer, distance})
+		}
+	}
+	return routes
+}
+
+// linkWeight returns the weight of the connection conn, whose remote's
+// connection back, if any, is reverse.
+func linkWeight(conn, reverse Connection) uint64 {
+	rtt := conn.rtt()
+	if reverse != nil && reverse.rtt() > rtt {
+		rtt = reverse.rtt()
+	}
+	return 1 + uint64(rtt/time.Millisecond)
+}
+
+type routeCandidate struct {
+	peer     *Peer
+	distance uint64
+}
+
+// routeQueue is a heap of routeCandidates, nearest first, and then by
+// name.
+type routeQueue []routeCandidate
+
+func (q routeQueue) Len() int { return len(q) }
+
+func (q routeQueue) Less(i, j int) bool {
+	if q[i].distance != q[j].distance {
+		return q[i].distance < q[j].distance
+	}
+	return q[i].peer.Name < q[j].peer.Name
+}
+
+func (q routeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *routeQueue) Push(x interface{}) { *q = append(*q, x.(routeCandidate)) }
+
+func (q *routeQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
 // Apply f to all peers reachable by peer. If establishedAndSymmetric is true,
 // only peers with established bidirectional connections will be selected. The
 // exclude maps is treated as a set of remote peers to blacklist.
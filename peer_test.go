@@ -1,6 +1,11 @@
 package mesh
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 func newPeerFrom(peer *Peer) *Peer {
 	return newPeerFromSummary(peer.peerSummary)
@@ -10,6 +15,65 @@ func TestPeerRoutes(t *testing.T) {
 	t.Skip("TODO")
 }
 
+// connectWithRTTs connects from and to both ways, with the RTTs measured
+// at each end.
+func connectWithRTTs(from, to *Peer, rtt, back time.Duration) {
+	conn := newRemoteConnection(from, to, "", false, true)
+	conn.roundTrip = rtt
+	from.connections[to.Name] = conn
+	conn = newRemoteConnection(to, from, "", false, true)
+	conn.roundTrip = back
+	to.connections[from.Name] = conn
+}
+
+func TestPeerWeightedRoutes(t *testing.T) {
+	var a, slow, fast, d *Peer
+	for i, p := range []**Peer{&a, &slow, &fast, &d} {
+		*p = newPeer(PeerName(i+1), "", PeerUID(i+1), 0, 0)
+	}
+	connectWithRTTs(a, slow, 0, 0)
+	connectWithRTTs(slow, d, 0, 0)
+	connectWithRTTs(a, fast, 0, 0)
+	connectWithRTTs(fast, d, 0, 0)
+
+	// Without latencies, as routes.
+	_, expected := a.routes(nil, true)
+	require.Equal(t, unicastRoutes(expected), a.weightedRoutes(true))
+	require.Equal(t, slow.Name, expected[d.Name])
+
+	// The latency measured either way counts.
+	connectWithRTTs(slow, d, 0, 100*time.Millisecond)
+	connectWithRTTs(fast, d, 2*time.Millisecond, time.Millisecond)
+	require.Equal(t, unicastRoutes{a.Name: UnknownPeerName, slow.Name: slow.Name, fast.Name: fast.Name, d.Name: fast.Name}, a.weightedRoutes(true))
+	require.Equal(t, a.Name, slow.weightedRoutes(true)[d.Name], "slow itself avoids its slow link")
+
+	// Unestablished connections are skipped, unless asked for.
+	d.connections[fast.Name].(*remoteConnection).established = false
+	require.Equal(t, slow.Name, a.weightedRoutes(true)[d.Name])
+	require.Equal(t, fast.Name, a.weightedRoutes(false)[d.Name])
+}
+
+func TestRoutesWeightedOnlyWhenAllPeersAre(t *testing.T) {
+	a, peers := newNode(PeerName(1))
+	var slow, fast, d *Peer
+	for i, p := range []**Peer{&slow, &fast, &d} {
+		*p = newPeer(PeerName(i+2), "", PeerUID(i+2), 0, 0)
+		(*p).WeightedRoutes = true
+		peers.byName[(*p).Name] = *p
+	}
+	connectWithRTTs(a, slow, 0, 0)
+	connectWithRTTs(slow, d, 0, 100*time.Millisecond)
+	connectWithRTTs(a, fast, 0, 0)
+	connectWithRTTs(fast, d, 0, 0)
+	r := newRoutes(peers.ourself, peers)
+	defer r.stop()
+	require.Equal(t, fast.Name, r.calculateUnicast(true)[d.Name])
+
+	// A peer which routes by hops makes us do likewise.
+	d.WeightedRoutes = false
+	require.Equal(t, slow.Name, r.calculateUnicast(true)[d.Name])
+}
+
 func TestPeerForEachConnectedPeer(t *testing.T) {
 	t.Skip("TODO")
 }
@@ -21,10 +21,15 @@ type Peers struct {
 	byShortID map[PeerShortID]shortIDPeers
 	onGC      []func(*Peer)
 
+	// Called with PeerJoined and PeerRestarted events
+	onMembershipEvent []func(MembershipEvent)
+
 	// Called when the mapping from short IDs to peers changes
 	onInvalidateShortIDs []func()
 	timer                *time.Timer
 	pendingGC            bool
+	quit                 chan struct{}
+	finished             chan struct{} // closed to signal that actorLoop has finished
 }
 
 type shortIDPeers struct {
@@ -44,6 +49,7 @@ type connectionSummary struct {
 	RemoteTCPAddr string
 	Outbound      bool
 	Established   bool
+	RTT           time.Duration
 }
 
 // Due to changes to Peers that need to be sent out
@@ -52,6 +58,9 @@ type peersPendingNotifications struct {
 	// Peers that have been GCed
 	removed []*Peer
 
+	// Peers that have been added, or found to have restarted
+	events []MembershipEvent
+
 	// The mapping from short IDs to peers changed
 	invalidateShortIDs bool
 
@@ -68,6 +77,8 @@ func newPeers(ourself *localPeer) *Peers {
 		byName:    make(map[PeerName]*Peer),
 		byShortID: make(map[PeerShortID]shortIDPeers),
 		timer:     time.NewTimer(gcInterval),
+		quit:      make(chan struct{}),
+		finished:  make(chan struct{}),
 	}
 	peers.fetchWithDefault(ourself.Peer)
 	peers.timer.Stop()
@@ -81,17 +92,31 @@ func (peers *Peers) Descriptions() []PeerDescription {
 	defer peers.RUnlock()
 	descriptions := make([]PeerDescription, 0, len(peers.byName))
 	for _, peer := range peers.byName {
-		descriptions = append(descriptions, PeerDescription{
-			Name:           peer.Name,
-			NickName:       peer.peerSummary.NickName,
-			UID:            peer.UID,
-			Self:           peer.Name == peers.ourself.Name,
-			NumConnections: len(peer.connections),
-		})
+		descriptions = append(descriptions, peers.describe(peer))
 	}
 	return descriptions
 }
 
+// Must hold the read lock.
+func (peers *Peers) describe(peer *Peer) PeerDescription {
+	self := peer.Name == peers.ourself.Name
+	var numConnections int
+	if self {
+		// Our connections change under our own lock, not that of Peers.
+		numConnections = peers.ourself.connectionCount()
+	} else {
+		numConnections = len(peer.connections)
+	}
+	return PeerDescription{
+		Name:           peer.Name,
+		NickName:       peer.peerSummary.NickName,
+		UID:            peer.UID,
+		Self:           self,
+		NumConnections: numConnections,
+		Metadata:       copyMetadata(peer.Metadata),
+	}
+}
+
 // OnGC adds a new function to be set of functions that will be executed on
 // all subsequent GC runs, receiving the GC'd peer.
 func (peers *Peers) OnGC(callback func(*Peer)) {
@@ -105,6 +130,17 @@ func (peers *Peers) OnGC(callback func(*Peer)) {
 	peers.onGC = append(peers.onGC, callback)
 }
 
+// onMembership adds a function to be called with a PeerJoined event for
+// every peer subsequently added, and a PeerRestarted event for every peer
+// subsequently found to have a new UID.
+func (peers *Peers) onMembership(callback func(MembershipEvent)) {
+	peers.Lock()
+	defer peers.Unlock()
+
+	// Safe, as in OnGC
+	peers.onMembershipEvent = append(peers.onMembershipEvent, callback)
+}
+
 // OnInvalidateShortIDs adds a new function to a set of functions that will be
 // executed on all subsequent GC runs, when the mapping from short IDs to
 // peers has changed.
@@ -120,8 +156,15 @@ func (peers *Peers) unlockAndNotify(pending *peersPendingNotifications) {
 	broadcastLocalPeer := (pending.reassignLocalShortID && peers.reassignLocalShortID(pending)) || pending.localPeerModified
 	onGC := peers.onGC
 	onInvalidateShortIDs := peers.onInvalidateShortIDs
+	onMembershipEvent := peers.onMembershipEvent
 	peers.Unlock()
 
+	for _, callback := range onMembershipEvent {
+		for _, event := range pending.events {
+			callback(event)
+		}
+	}
+
 	if pending.removed != nil {
 		for _, callback := range onGC {
 			for _, peer := range pending.removed {
@@ -141,6 +184,10 @@ func (peers *Peers) unlockAndNotify(pending *peersPendingNotifications) {
 	}
 }
 
+func (pending *peersPendingNotifications) joined(peer *Peer) {
+	pending.events = append(pending.events, MembershipEvent{Type: PeerJoined, Peer: peer.Name, UID: peer.UID})
+}
+
 func (peers *Peers) addByShortID(peer *Peer, pending *peersPendingNotifications) {
 	if !peer.HasShortID {
 		return
@@ -302,6 +349,7 @@ func (peers *Peers) fetchWithDefault(peer *Peer) *Peer {
 
 	peers.byName[peer.Name] = peer
 	peers.addByShortID(peer, &pending)
+	pending.joined(peer)
 	peer.localRefCount++
 	return peer
 }
@@ -350,14 +398,27 @@ func (peers *Peers) forEach(fun func(*Peer)) {
 }
 
 func (peers *Peers) actorLoop() {
-	for range peers.timer.C {
-		peers.GarbageCollect()
-		peers.Lock()
-		peers.pendingGC = false
-		peers.Unlock()
+	defer close(peers.finished)
+	for {
+		select {
+		case <-peers.timer.C:
+			peers.GarbageCollect()
+			peers.Lock()
+			peers.pendingGC = false
+			peers.Unlock()
+		case <-peers.quit:
+			peers.timer.Stop()
+			return
+		}
 	}
 }
 
+// stop terminates the garbage collection actor and waits for it to finish.
+func (peers *Peers) stop() {
+	close(peers.quit)
+	<-peers.finished
+}
+
 // Merge an incoming update with our own topology.
 //
 // We add peers hitherto unknown to us, and update peers for which the
@@ -378,6 +439,7 @@ func (peers *Peers) applyUpdate(update []byte) (peerNameSet, peerNameSet, error)
 	for name, newPeer := range newPeers {
 		peers.byName[name] = newPeer
 		peers.addByShortID(newPeer, &pending)
+		pending.joined(newPeer)
 	}
 
 	// Now apply the updates
@@ -526,9 +588,16 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 							(!newPeer.HasShortID || peer.HasShortID)))) {
 				continue
 			}
+			if newPeer.UID != peer.UID && peer.UID != 0 { // not a placeholder
+				pending.events = append(pending.events, MembershipEvent{Type: PeerRestarted, Peer: name, UID: newPeer.UID})
+			}
 			peer.Version = newPeer.Version
 			peer.UID = newPeer.UID
+			peer.nickNameLock.Lock()
 			peer.NickName = newPeer.NickName
+			peer.nickNameLock.Unlock()
+			peer.Metadata = newPeer.Metadata
+			peer.WeightedRoutes = newPeer.WeightedRoutes
 			peer.connections = makeConnsMap(peer, connSummaries, peers.byName)
 
 			if newPeer.ShortID != peer.ShortID || newPeer.HasShortID != peer.HasShortID {
@@ -555,6 +624,7 @@ func (peer *Peer) encode(enc *gob.Encoder) {
 			conn.remoteTCPAddress(),
 			conn.isOutbound(),
 			conn.isEstablished(),
+			conn.rtt(),
 		})
 	}
 
@@ -579,6 +649,7 @@ func makeConnsMap(peer *Peer, connSummaries []connectionSummary, byName map[Peer
 		name := PeerNameFromBin(connSummary.NameByte)
 		remotePeer := byName[name]
 		conn := newRemoteConnection(peer, remotePeer, connSummary.RemoteTCPAddr, connSummary.Outbound, connSummary.Established)
+		conn.roundTrip = connSummary.RTT
 		conns[name] = conn
 	}
 	return conns
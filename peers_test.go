@@ -310,6 +310,26 @@ func TestShortIDPropagation(t *testing.T) {
 	require.NotEqual(t, old.ShortID, peers12.ShortID)
 }
 
+func TestPeersMembershipEvents(t *testing.T) {
+	_, peers1 := newNode(PeerName(1))
+	_, peers2 := newNode(PeerName(2))
+	var events []MembershipEvent
+	peers1.onMembership(func(event MembershipEvent) { events = append(events, event) })
+
+	peers1.AddTestConnection(peers2.ourself.Peer)
+	require.Equal(t, []MembershipEvent{{Type: PeerJoined, Peer: PeerName(2), UID: peers2.ourself.UID}}, events)
+	_, _, err := peers1.applyUpdate(peers2.encodePeers(peers2.names()))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// Peer 2 restarts, and makes its new incarnation supersede the old.
+	_, restarted := newNode(PeerName(2))
+	restarted.ourself.setVersionBeyond(peers2.ourself.Version)
+	_, _, err = peers1.applyUpdate(restarted.encodePeers(restarted.names()))
+	require.NoError(t, err)
+	require.Equal(t, MembershipEvent{Type: PeerRestarted, Peer: PeerName(2), UID: restarted.ourself.UID}, events[1])
+}
+
 func TestShortIDCollision(t *testing.T) {
 	// Create 3 peers
 	_, peers1 := newNode(PeerName(1))
@@ -0,0 +1,116 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The phi accrual failure detector of Hayashibara et al. estimates the
+// suspicion that a remote has failed, from how overdue its next heartbeat
+// is given the distribution of the latest intervals between heartbeats.
+// A phi of 1 means a chance of about 10% that the remote is fine, 2 of
+// 1%, 3 of 0.1%, and so on.
+//
+// Heartbeats are sent alongside everything else, so they can be held up
+// behind a long send. Since anything received shows the remote is alive,
+// how overdue it is counts from whatever arrived last, though only the
+// intervals between heartbeats make up the distribution.
+const (
+	phiWindowSize = 100
+	// The standard deviation assumed is at least this fraction of the
+	// mean, since heartbeats sent on a ticker arrive very regularly until
+	// they do not.
+	phiMinStdDevFraction = 0.1
+	// How often the suspicion is checked against Config.PhiThreshold.
+	phiCheckInterval = tcpHeartbeat / 10
+)
+
+// phiAccrual records the arrival of heartbeats, and of anything else, on
+// a connection.
+type phiAccrual struct {
+	sync.Mutex
+	intervals     []float64 // in seconds, a ring of the latest
+	next          int       // where the next interval goes, once full
+	sum           float64
+	sumSquares    float64
+	lastHeartbeat time.Time
+	last          time.Time // of anything
+}
+
+// newPhiAccrual returns a phiAccrual expecting heartbeats every interval,
+// the first after now.
+func newPhiAccrual(interval time.Duration, now time.Time) *phiAccrual {
+	p := &phiAccrual{lastHeartbeat: now, last: now}
+	p.add(interval.Seconds())
+	return p
+}
+
+func (p *phiAccrual) heartbeat(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.add(now.Sub(p.lastHeartbeat).Seconds())
+	p.lastHeartbeat, p.last = now, now
+}
+
+// arrival records the arrival of anything, heartbeat or not.
+func (p *phiAccrual) arrival(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.last = now
+}
+
+func (p *phiAccrual) add(interval float64) {
+	if len(p.intervals) < phiWindowSize {
+		p.intervals = append(p.intervals, interval)
+	} else {
+		old := p.intervals[p.next]
+		p.sum -= old
+		p.sumSquares -= old * old
+		p.intervals[p.next] = interval
+		p.next = (p.next + 1) % phiWindowSize
+	}
+	p.sum += interval
+	p.sumSquares += interval * interval
+}
+
+// phi returns the suspicion at now that the remote has failed.
+func (p *phiAccrual) phi(now time.Time) float64 {
+	p.Lock()
+	defer p.Unlock()
+	n := float64(len(p.intervals))
+	mean := p.sum / n
+	stdDev := math.Sqrt(math.Max(p.sumSquares/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, mean*phiMinStdDevFraction)
+	// A logistic approximation of the normal distribution's CDF.
+	elapsed := now.Sub(p.last).Seconds()
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		if e == 0 {
+			return math.MaxFloat64
+		}
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func (p *phiAccrual) sinceLast(now time.Time) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	return now.Sub(p.last)
+}
+
+// checkHeartbeats returns an error if the suspicion that the remote has
+// failed has reached Config.PhiThreshold.
+func (conn *LocalConnection) checkHeartbeats(now time.Time) error {
+	threshold := conn.router.PhiThreshold
+	if threshold <= 0 {
+		return nil
+	}
+	if phi := conn.heartbeats.phi(now); phi >= threshold {
+		return fmt.Errorf("nothing received for %v (phi %.1f)", conn.heartbeats.sinceLast(now).Round(time.Millisecond), phi)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhiAccrual(t *testing.T) {
+	start := time.Now()
+	p := newPhiAccrual(time.Second, start)
+	now := start
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		p.heartbeat(now)
+	}
+	require.True(t, p.phi(now.Add(500*time.Millisecond)) < 0.1, "early")
+	onTime := p.phi(now.Add(time.Second))
+	require.True(t, onTime > 0.1 && onTime < 1, "on time: %v", onTime)
+	late := p.phi(now.Add(1200 * time.Millisecond))
+	require.True(t, late > onTime, "late: %v", late)
+	require.True(t, p.phi(now.Add(2*time.Second)) > 8, "overdue")
+
+	// Anything else arriving while a heartbeat is held up shows the remote
+	// is alive, without counting as a heartbeat.
+	busy := newPhiAccrual(time.Second, start)
+	now = start
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		busy.heartbeat(now)
+	}
+	busy.arrival(now.Add(1900 * time.Millisecond))
+	require.True(t, busy.phi(now.Add(2*time.Second)) < 0.1, "busy")
+	require.Len(t, busy.intervals, 11)
+	busy.heartbeat(now.Add(3 * time.Second))
+	require.InDelta(t, 14.0, busy.sum, 1e-6)
+
+	// Irregular heartbeats make delays less suspicious.
+	irregular := newPhiAccrual(time.Second, start)
+	now = start
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Duration(500+1000*(i%2)) * time.Millisecond)
+		irregular.heartbeat(now)
+	}
+	require.True(t, irregular.phi(now.Add(2*time.Second)) < 8, "irregular")
+
+	// Heartbeats long ago are forgotten.
+	for i := 0; i < phiWindowSize; i++ {
+		now = now.Add(time.Second)
+		p.heartbeat(now)
+	}
+	require.Len(t, p.intervals, phiWindowSize)
+	require.InDelta(t, float64(phiWindowSize), p.sum, 1e-6)
+}
+
+func TestCheckHeartbeats(t *testing.T) {
+	start := time.Now()
+	conn := &LocalConnection{router: &Router{}, heartbeats: newPhiAccrual(time.Second, start)}
+	require.NoError(t, conn.checkHeartbeats(start.Add(time.Hour)), "no threshold")
+
+	conn.router.PhiThreshold = 8
+	require.NoError(t, conn.checkHeartbeats(start.Add(time.Second)))
+	require.Error(t, conn.checkHeartbeats(start.Add(3*time.Second)))
+}
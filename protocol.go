@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -19,7 +21,7 @@ const (
 
 	// ProtocolMaxVersion establishes the highest protocol version among peers
 	// that we're willing to try to communicate with.
-	ProtocolMaxVersion = 2
+	ProtocolMaxVersion = 3
 )
 
 var (
@@ -37,8 +39,10 @@ var (
 		"UID",
 	}
 
-	errExpectedCrypto   = fmt.Errorf("password specified, but peer requested an unencrypted connection")
-	errExpectedNoCrypto = fmt.Errorf("no password specificed, but peer requested an encrypted connection")
+	errExpectedCrypto      = fmt.Errorf("password specified, but peer requested an unencrypted connection")
+	errExpectedNoCrypto    = fmt.Errorf("no password specificed, but peer requested an encrypted connection")
+	errBadIdentityProof    = fmt.Errorf("peer failed to prove possession of its identity key")
+	errUnencryptedIdentity = fmt.Errorf("peer claimed an identity on an unencrypted connection")
 )
 
 type protocolIntroConn interface {
@@ -58,6 +62,16 @@ type protocolIntroParams struct {
 	Features   map[string]string
 	Conn       protocolIntroConn
 	Password   []byte
+	Identity   ed25519.PrivateKey
+
+	// Whether we check the identity of the remote, e.g. against
+	// AllowedPeers, for which, as for proving our own Identity, the
+	// connection must be encrypted.
+	CheckIdentity bool
+
+	// Further passwords the remote may use, e.g. while a new password is
+	// being rolled out. Only honoured from protocol V2.
+	AcceptPasswords [][]byte
 }
 
 // The results from a successful protocol intro.
@@ -67,6 +81,14 @@ type protocolIntroResults struct {
 	Sender     tcpSender
 	SessionKey *[32]byte
 	Version    byte
+
+	// Which password the remote encrypts with, if we have one: 0 for
+	// Password, and then AcceptPasswords in order.
+	PasswordIndex int
+
+	// The remote's long-term identity key, if it proved possession of
+	// one; nil otherwise.
+	IdentityKey ed25519.PublicKey
 }
 
 // DoIntro executes the protocol introduction.
@@ -96,7 +118,8 @@ func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error
 	switch res.Version {
 	case 1:
 		err = res.doIntroV1(params, pubKey, privKey)
-	case 2:
+	case 2, 3:
+		// V3 differs only in how gossip is encoded; see gossipCodec.
 		err = res.doIntroV2(params, pubKey, privKey)
 	default:
 		panic("unhandled protocol version")
@@ -204,7 +227,7 @@ func (res *protocolIntroResults) doIntroV1(params protocolIntroParams, pubKey, p
 			return err
 		}
 
-		res.setupCrypto(params, remotePubKey, privKey)
+		res.setupCrypto(params, remotePubKey, privKey, [][]byte{params.Password})
 	}
 
 	res.Features = filterV1Features(res.Features)
@@ -238,7 +261,21 @@ func filterV1Features(intro map[string]string) map[string]string {
 // for an encrypted connection.
 //
 // The first message contains the encoded features map (so in contrast
-// to V1, it will be encrypted on an encrypted connection).
+// to V1, it will be encrypted on an encrypted connection). It always
+// carries a random "IdentityNonce" challenge and, for a peer with a
+// long-term identity, its public key as "IdentityKey". Without a password,
+// a peer with an identity, or which checks the identities of others, also
+// sends an ephemeral public key as "SessionPublicKey"; if both sides send
+// one, the rest of the connection is encrypted with the key agreed from
+// them.
+//
+// A peer that sent an IdentityKey then sends a second message: its
+// signature of the remote's nonce and both ephemeral public keys, proving
+// possession of the identity for this very connection. Since the proof is
+// bound to the session key, a peer relaying the intro cannot then take
+// over the connection. An identity is only accepted on an encrypted
+// connection, lest it be stripped of its session public keys; a peer which
+// does not check identities ignores the claims of others instead.
 func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, privKey *[32]byte) error {
 	// Public key exchange
 	var wbuf []byte
@@ -265,6 +302,7 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 		return err
 	}
 
+	var remotePubKey []byte
 	switch rbuf[0] {
 	case 0:
 		if pubKey != nil {
@@ -286,7 +324,8 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 
 		res.Sender = newLengthPrefixTCPSender(params.Conn)
 		res.Receiver = newLengthPrefixTCPReceiver(params.Conn)
-		res.setupCrypto(params, rbuf, privKey)
+		res.setupCrypto(params, rbuf, privKey, append([][]byte{params.Password}, params.AcceptPasswords...))
+		remotePubKey = rbuf
 
 	default:
 		return fmt.Errorf("Bad encryption flag %d", rbuf[0])
@@ -297,9 +336,25 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 	}
 
 	// Features exchange
+	nonce := randBytes(identityNonceSize)
+	features := make(map[string]string, len(params.Features)+2)
+	for k, v := range params.Features {
+		features[k] = v
+	}
+	features["IdentityNonce"] = hex.EncodeToString(nonce)
+	if params.Identity != nil {
+		features["IdentityKey"] = hex.EncodeToString(params.Identity.Public().(ed25519.PublicKey))
+	}
+	if pubKey == nil && (params.Identity != nil || params.CheckIdentity) {
+		var err error
+		if pubKey, privKey, err = generateKeyPair(); err != nil {
+			return err
+		}
+		features["SessionPublicKey"] = hex.EncodeToString(pubKey[:])
+	}
 	go func() {
 		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(&params.Features); err != nil {
+		if err := gob.NewEncoder(buf).Encode(&features); err != nil {
 			writeDone <- err
 			return
 		}
@@ -320,15 +375,114 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 		return err
 	}
 
-	return nil
+	// Decrypting the features told us which of our passwords the remote
+	// uses. Each side carries on sending with its own password.
+	if receiver, ok := res.Receiver.(*encryptedTCPReceiver); ok {
+		res.PasswordIndex = receiver.keyIndex
+		if !params.Outbound {
+			// Overlays need a single key; use the outbound side's.
+			res.SessionKey = receiver.state.sessionKey
+		}
+	}
+
+	if remotePubKey == nil && privKey != nil {
+		var err error
+		if remotePubKey, err = res.encryptSession(params, privKey); err != nil {
+			return err
+		}
+	}
+	var ourPubKey []byte
+	if remotePubKey != nil {
+		ourPubKey = pubKey[:]
+	}
+	return res.exchangeIdentityProofs(params, nonce, ourPubKey, remotePubKey)
+}
+
+// encryptSession encrypts the rest of a connection without a password,
+// using the key agreed from the remote's SessionPublicKey, if it sent one,
+// and privKey, which we sent the public key of. It returns the remote's
+// public key.
+func (res *protocolIntroResults) encryptSession(params protocolIntroParams, privKey *[32]byte) ([]byte, error) {
+	remotePubKeyStr, offered := res.Features["SessionPublicKey"]
+	if !offered {
+		return nil, nil
+	}
+	remotePubKey, err := hex.DecodeString(remotePubKeyStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(remotePubKey) != 32 {
+		return nil, fmt.Errorf("bad session public key length %d", len(remotePubKey))
+	}
+	var remotePubKeyArr [32]byte
+	copy(remotePubKeyArr[:], remotePubKey)
+	// Both sides agree on the same key, which overlays use too.
+	res.SessionKey = formSessionKey(&remotePubKeyArr, privKey, nil)
+	res.Sender = newEncryptedTCPSender(res.Sender, res.SessionKey, params.Outbound)
+	res.Receiver = newEncryptedTCPReceiver(res.Receiver, []*[32]byte{res.SessionKey}, params.Outbound)
+	return remotePubKey, nil
 }
 
-func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte) {
+// exchangeIdentityProofs sends our proof of identity if the remote
+// challenged us, and checks the remote's proof if it claimed an identity.
+func (res *protocolIntroResults) exchangeIdentityProofs(params protocolIntroParams, nonce, ourPubKey, remotePubKey []byte) error {
+	writeDone := make(chan error, 1)
+	remoteNonceStr, challenged := res.Features["IdentityNonce"]
+	if params.Identity != nil && challenged {
+		remoteNonce, err := hex.DecodeString(remoteNonceStr)
+		if err != nil {
+			return err
+		}
+		proof := signIdentityProof(params.Identity, remoteNonce, ourPubKey, remotePubKey)
+		go func() {
+			writeDone <- res.Sender.Send(proof)
+		}()
+	} else {
+		writeDone <- nil
+	}
+
+	if remoteKeyStr, claimed := res.Features["IdentityKey"]; claimed {
+		remoteKey, err := hex.DecodeString(remoteKeyStr)
+		if err != nil {
+			return err
+		}
+		if len(remoteKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("bad identity key length %d", len(remoteKey))
+		}
+		_, encrypted := res.Receiver.(*encryptedTCPReceiver)
+		if !encrypted && (params.Identity != nil || params.CheckIdentity) {
+			return errUnencryptedIdentity
+		}
+		proof, err := res.Receiver.Receive()
+		if err != nil {
+			return err
+		}
+		if !encrypted {
+			// We did not offer a session key, not caring who it is.
+			return <-writeDone
+		}
+		if !verifyIdentityProof(remoteKey, proof, nonce, remotePubKey, ourPubKey) {
+			return errBadIdentityProof
+		}
+		res.IdentityKey = remoteKey
+	}
+
+	return <-writeDone
+}
+
+// setupCrypto encrypts what we send with our password, and decrypts what
+// we receive with whichever of the candidate passwords the remote turns
+// out to use.
+func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte, candidates [][]byte) {
 	var remotePubKeyArr [32]byte
 	copy(remotePubKeyArr[:], remotePubKey)
 	res.SessionKey = formSessionKey(&remotePubKeyArr, privKey, params.Password)
+	receiveKeys := make([]*[32]byte, len(candidates))
+	for i, password := range candidates {
+		receiveKeys[i] = formSessionKey(&remotePubKeyArr, privKey, password)
+	}
 	res.Sender = newEncryptedTCPSender(res.Sender, res.SessionKey, params.Outbound)
-	res.Receiver = newEncryptedTCPReceiver(res.Receiver, res.SessionKey, params.Outbound)
+	res.Receiver = newEncryptedTCPReceiver(res.Receiver, receiveKeys, params.Outbound)
 }
 
 // ProtocolTag identifies the type of msg encoded in a ProtocolMsg.
@@ -351,6 +505,38 @@ const (
 	ProtocolGossipBroadcast
 	// ProtocolOverlayControlMsg identifies a control msg.
 	ProtocolOverlayControlMsg
+	// ProtocolGoodbye identifies a msg announcing that the sender is
+	// shutting down the connection.
+	ProtocolGoodbye
+	// ProtocolRekey identifies a msg asking the remote to replace the
+	// session key it encrypts with, carrying an ephemeral public key.
+	ProtocolRekey
+	// ProtocolRekeyAck identifies the reply to a ProtocolRekey msg,
+	// carrying the remote's ephemeral public key. It is the last msg
+	// encrypted with the old session key.
+	ProtocolRekeyAck
+	// ProtocolChannelID identifies a msg announcing the ID by which
+	// subsequent gossip msgs refer to a channel. See internedGossipCodec.
+	ProtocolChannelID
+	// ProtocolCompressed identifies a deflated msg, which in turn starts
+	// with its own tag.
+	ProtocolCompressed
+	// ProtocolChunk identifies a fragment of a msg too large to send
+	// whole. See reassembler.
+	ProtocolChunk
+	// ProtocolGossipQuery identifies a gossip query, relayed like a
+	// broadcast. See gossipChannel.GossipQuery.
+	ProtocolGossipQuery
+	// ProtocolGossipQueryReply identifies the reply to a gossip query,
+	// relayed like a unicast.
+	ProtocolGossipQueryReply
+	// ProtocolGossipDigest identifies a digest of a channel's gossip
+	// state. See DigestGossiper.
+	ProtocolGossipDigest
+	// ProtocolHeartbeatEcho identifies a request, sent with each
+	// heartbeat, for the remote to echo it, or the echo, for measuring
+	// the RTT of the connection.
+	ProtocolHeartbeatEcho
 )
 
 // ProtocolMsg combines a tag and encoded msg.
@@ -362,3 +548,10 @@ type protocolMsg struct {
 type protocolSender interface {
 	SendProtocolMsg(m protocolMsg) error
 }
+
+// turnTakingSender is a protocolSender which can send a msg taking a
+// gossip turn for each frame, rather than for the whole msg, such as when
+// sending it in chunks.
+type turnTakingSender interface {
+	sendInTurns(m protocolMsg, turns *gossipTurns) error
+}
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -33,6 +36,46 @@ func formSessionKey(remotePublicKey, localPrivateKey *[32]byte, secretKey []byte
 	return &sessionKey
 }
 
+// formRekeyedSessionKey forms the key that succeeds sessionKey, from a
+// fresh ephemeral key exchange. Mixing in the old key means an attacker
+// needs it as well as the new exchange; hashing means the new key reveals
+// nothing of the old one, so discarding the ephemeral private keys and the
+// old key gives forward secrecy within a connection.
+func formRekeyedSessionKey(remotePublicKey, localPrivateKey, sessionKey *[32]byte) *[32]byte {
+	return formSessionKey(remotePublicKey, localPrivateKey, sessionKey[:])
+}
+
+const identityNonceSize = 32
+
+var identityProofLabel = []byte("weave identity proof v1")
+
+// signIdentityProof is used during protocol introduction to prove
+// possession of our identity key. The signature covers the remote's
+// challenge and the ephemeral public keys of both sides (if any), so it
+// cannot be replayed on another connection.
+func signIdentityProof(identity ed25519.PrivateKey, remoteNonce, ourPubKey, remotePubKey []byte) []byte {
+	return ed25519.Sign(identity, identityProofMessage(remoteNonce, ourPubKey, remotePubKey))
+}
+
+// verifyIdentityProof checks a proof made by signIdentityProof on the
+// remote side of the connection.
+func verifyIdentityProof(remoteKey ed25519.PublicKey, proof, nonce, remotePubKey, ourPubKey []byte) bool {
+	return ed25519.Verify(remoteKey, identityProofMessage(nonce, remotePubKey, ourPubKey), proof)
+}
+
+func identityProofMessage(nonce, signerPubKey, verifierPubKey []byte) []byte {
+	msg := make([]byte, 0, len(identityProofLabel)+len(nonce)+len(signerPubKey)+len(verifierPubKey)+2)
+	msg = append(msg, identityProofLabel...)
+	msg = append(msg, nonce...)
+	// Length-prefix the ephemeral keys, which are absent on
+	// unencrypted connections.
+	msg = append(msg, byte(len(signerPubKey)))
+	msg = append(msg, signerPubKey...)
+	msg = append(msg, byte(len(verifierPubKey)))
+	msg = append(msg, verifierPubKey...)
+	return msg
+}
+
 // TCP Senders/Receivers
 
 // TCPCryptoState stores session key, nonce, and sequence state.
@@ -66,6 +109,14 @@ func (s *tcpCryptoState) advance() {
 	binary.BigEndian.PutUint64(s.nonce[16:24], s.seqNo)
 }
 
+// rekey switches to sessionKey, restarting the sequence. Nonces may be
+// reused as the key is new.
+func (s *tcpCryptoState) rekey(sessionKey *[32]byte) {
+	s.sessionKey = sessionKey
+	s.seqNo = 0
+	binary.BigEndian.PutUint64(s.nonce[16:24], s.seqNo)
+}
+
 // TCPSender describes anything that can send byte buffers.
 // It abstracts over the different protocol version senders.
 type tcpSender interface {
@@ -113,6 +164,7 @@ func (sender *lengthPrefixTCPSender) Send(msg []byte) error {
 
 // Implement TCPSender by wrapping an existing TCPSender with tcpCryptoState.
 type encryptedTCPSender struct {
+	rekeys uint64 // accessed atomically, so first for alignment
 	sync.RWMutex
 	sender tcpSender
 	state  *tcpCryptoState
@@ -126,11 +178,44 @@ func newEncryptedTCPSender(sender tcpSender, sessionKey *[32]byte, outbound bool
 func (sender *encryptedTCPSender) Send(msg []byte) error {
 	sender.Lock()
 	defer sender.Unlock()
+	return sender.send(msg)
+}
+
+func (sender *encryptedTCPSender) send(msg []byte) error {
 	encodedMsg := secretbox.Seal(nil, msg, &sender.state.nonce, sender.state.sessionKey)
 	sender.state.advance()
 	return sender.sender.Send(encodedMsg)
 }
 
+// rekey answers the remote's request for a new session key, made by
+// encryptedTCPReceiver.beginRekey, by sending it our ephemeral public key
+// in the msg made by ack. That is the last msg sealed with the old key, so
+// the remote knows where to switch.
+func (sender *encryptedTCPSender) rekey(remotePubKey []byte, ack func(pubKey []byte) []byte) error {
+	if len(remotePubKey) != 32 {
+		return fmt.Errorf("bad rekey public key length %d", len(remotePubKey))
+	}
+	var remotePubKeyArr [32]byte
+	copy(remotePubKeyArr[:], remotePubKey)
+	pubKey, privKey, err := generateKeyPair()
+	if err != nil {
+		return err
+	}
+	sender.Lock()
+	defer sender.Unlock()
+	if err := sender.send(ack(pubKey[:])); err != nil {
+		return err
+	}
+	sender.state.rekey(formRekeyedSessionKey(&remotePubKeyArr, privKey, sender.state.sessionKey))
+	atomic.AddUint64(&sender.rekeys, 1)
+	return nil
+}
+
+// rekeyCount returns how many times the session key has been replaced.
+func (sender *encryptedTCPSender) rekeyCount() uint64 {
+	return atomic.LoadUint64(&sender.rekeys)
+}
+
 // tcpReceiver describes anything that can receive byte buffers.
 // It abstracts over the different protocol version receivers.
 type tcpReceiver interface {
@@ -179,12 +264,23 @@ func (receiver *lengthPrefixTCPReceiver) Receive() ([]byte, error) {
 
 // encryptedTCPReceiver implements TCPReceiver by wrapping a TCPReceiver with TCPCryptoState.
 type encryptedTCPReceiver struct {
-	receiver tcpReceiver
-	state    *tcpCryptoState
+	rekeys     uint64 // accessed atomically, so first for alignment
+	receiver   tcpReceiver
+	state      *tcpCryptoState
+	candidates []*[32]byte // session keys to try on the first msg
+	keyIndex   int         // index of the session key that worked
+	keySince   time.Time   // when we adopted the session key
+	rekeyKey   *[32]byte   // our ephemeral private key, while rekeying
 }
 
-func newEncryptedTCPReceiver(receiver tcpReceiver, sessionKey *[32]byte, outbound bool) *encryptedTCPReceiver {
-	return &encryptedTCPReceiver{receiver: receiver, state: newTCPCryptoState(sessionKey, !outbound)}
+// newEncryptedTCPReceiver returns a receiver that determines from the first
+// message which of the candidate sessionKeys the sender uses.
+func newEncryptedTCPReceiver(receiver tcpReceiver, sessionKeys []*[32]byte, outbound bool) *encryptedTCPReceiver {
+	r := &encryptedTCPReceiver{receiver: receiver, state: newTCPCryptoState(sessionKeys[0], !outbound), keySince: time.Now()}
+	if len(sessionKeys) > 1 {
+		r.candidates = sessionKeys
+	}
+	return r
 }
 
 // Receive implements TCPReceiver by reading from the wrapped TCPReceiver and
@@ -195,6 +291,19 @@ func (receiver *encryptedTCPReceiver) Receive() ([]byte, error) {
 		return nil, err
 	}
 
+	if receiver.candidates != nil {
+		for i, sessionKey := range receiver.candidates {
+			if decodedMsg, success := secretbox.Open(nil, msg, &receiver.state.nonce, sessionKey); success {
+				receiver.state.sessionKey = sessionKey
+				receiver.keyIndex = i
+				receiver.candidates = nil
+				receiver.state.advance()
+				return decodedMsg, nil
+			}
+		}
+		return nil, fmt.Errorf("Unable to decrypt TCP msg")
+	}
+
 	decodedMsg, success := secretbox.Open(nil, msg, &receiver.state.nonce, receiver.state.sessionKey)
 	if !success {
 		return nil, fmt.Errorf("Unable to decrypt TCP msg")
@@ -203,3 +312,47 @@ func (receiver *encryptedTCPReceiver) Receive() ([]byte, error) {
 	receiver.state.advance()
 	return decodedMsg, nil
 }
+
+// rekeyDue reports whether the session key has been used for more than
+// maxMsgs msgs or for longer than maxAge, and no rekey is in progress.
+func (receiver *encryptedTCPReceiver) rekeyDue(maxMsgs uint64, maxAge time.Duration, now time.Time) bool {
+	if receiver.rekeyKey != nil || receiver.candidates != nil {
+		return false
+	}
+	return receiver.state.seqNo >= maxMsgs || now.Sub(receiver.keySince) >= maxAge
+}
+
+// beginRekey returns an ephemeral public key, to be sent to the remote so
+// that it replaces the session key it sends us msgs with. See
+// encryptedTCPSender.rekey.
+func (receiver *encryptedTCPReceiver) beginRekey() ([]byte, error) {
+	pubKey, privKey, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	receiver.rekeyKey = privKey
+	return pubKey[:], nil
+}
+
+// completeRekey switches to the session key agreed with the remote, whose
+// ephemeral public key arrived in the last msg it sealed with the old key.
+func (receiver *encryptedTCPReceiver) completeRekey(remotePubKey []byte) error {
+	if receiver.rekeyKey == nil {
+		return fmt.Errorf("unexpected rekey acknowledgement")
+	}
+	if len(remotePubKey) != 32 {
+		return fmt.Errorf("bad rekey public key length %d", len(remotePubKey))
+	}
+	var remotePubKeyArr [32]byte
+	copy(remotePubKeyArr[:], remotePubKey)
+	receiver.state.rekey(formRekeyedSessionKey(&remotePubKeyArr, receiver.rekeyKey, receiver.state.sessionKey))
+	receiver.rekeyKey = nil
+	receiver.keySince = time.Now()
+	atomic.AddUint64(&receiver.rekeys, 1)
+	return nil
+}
+
+// rekeyCount returns how many times the session key has been replaced.
+func (receiver *encryptedTCPReceiver) rekeyCount() uint64 {
+	return atomic.LoadUint64(&receiver.rekeys)
+}
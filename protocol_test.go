@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 )
 
 type testConn struct {
@@ -87,6 +88,9 @@ func doProtocolIntro(t *testing.T, aver, bver byte, password []byte) byte {
 }
 
 func TestProtocolIntro(t *testing.T) {
+	require.Equal(t, 3, int(doProtocolIntro(t, 3, 3, nil)))
+	require.Equal(t, 3, int(doProtocolIntro(t, 3, 3, []byte("sekr1t"))))
+	require.Equal(t, 2, int(doProtocolIntro(t, 3, 2, []byte("sekr1t"))))
 	require.Equal(t, 2, int(doProtocolIntro(t, 2, 2, nil)))
 	require.Equal(t, 2, int(doProtocolIntro(t, 2, 2, []byte("sekr1t"))))
 	require.Equal(t, 1, int(doProtocolIntro(t, 1, 2, nil)))
@@ -94,3 +98,124 @@ func TestProtocolIntro(t *testing.T) {
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, nil)))
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, []byte("w0rd"))))
 }
+
+func doIdentityIntro(t *testing.T, aIdentity, bIdentity ed25519.PrivateKey, bChecks bool, password []byte) (protocolIntroResults, protocolIntroResults) {
+	aconn, bconn := connPair()
+	aresch := doIntro(t, protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: ProtocolMaxVersion,
+		Features:   map[string]string{"Name": "A"},
+		Conn:       aconn,
+		Outbound:   true,
+		Password:   password,
+		Identity:   aIdentity,
+	})
+	bresch := doIntro(t, protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: ProtocolMaxVersion,
+		Features:   map[string]string{"Name": "B"},
+		Conn:       bconn,
+		Outbound:   false,
+		Password:   password,
+		Identity:   bIdentity,
+
+		CheckIdentity: bChecks,
+	})
+	return <-aresch, <-bresch
+}
+
+func TestProtocolIntroIdentity(t *testing.T) {
+	aPub, aPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	bPub, bPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	for _, password := range [][]byte{nil, []byte("sekr1t")} {
+		ares, bres := doIdentityIntro(t, aPriv, bPriv, false, password)
+		require.Equal(t, bPub, ares.IdentityKey)
+		require.Equal(t, aPub, bres.IdentityKey)
+
+		ares, bres = doIdentityIntro(t, aPriv, nil, true, password)
+		require.Nil(t, ares.IdentityKey)
+		require.Equal(t, aPub, bres.IdentityKey)
+
+		// Proofs are bound to a session key, so without a password
+		// the connection is encrypted all the same.
+		require.IsType(t, &encryptedTCPSender{}, ares.Sender)
+		require.IsType(t, &encryptedTCPReceiver{}, bres.Receiver)
+		require.NotNil(t, ares.SessionKey)
+		require.Equal(t, ares.SessionKey, bres.SessionKey)
+	}
+
+	// Without a password, a peer which does not check identities ignores
+	// them, and is not made to encrypt.
+	ares, bres := doIdentityIntro(t, aPriv, nil, false, nil)
+	require.Nil(t, bres.IdentityKey)
+	require.Nil(t, ares.SessionKey)
+	require.IsType(t, &lengthPrefixTCPSender{}, ares.Sender)
+	require.IsType(t, &lengthPrefixTCPReceiver{}, bres.Receiver)
+}
+
+func TestIdentityProof(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	nonce := randBytes(identityNonceSize)
+	signerKey, verifierKey := randBytes(32), randBytes(32)
+	proof := signIdentityProof(priv, nonce, signerKey, verifierKey)
+	require.True(t, verifyIdentityProof(pub, proof, nonce, signerKey, verifierKey))
+	// A proof made for one connection must not verify on another
+	require.False(t, verifyIdentityProof(pub, proof, randBytes(identityNonceSize), signerKey, verifierKey))
+	require.False(t, verifyIdentityProof(pub, proof, nonce, verifierKey, signerKey))
+}
+
+func TestProtocolRekey(t *testing.T) {
+	ares, bres := doIdentityIntro(t, nil, nil, false, []byte("sekr1t"))
+	sender := ares.Sender.(*encryptedTCPSender)
+	receiver := bres.Receiver.(*encryptedTCPReceiver)
+
+	send := func(msg []byte) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- sender.Send(msg) }()
+		return done
+	}
+	receive := func(expected []byte) {
+		msg, err := receiver.Receive()
+		require.NoError(t, err)
+		require.Equal(t, expected, msg)
+	}
+
+	done := send([]byte("before"))
+	receive([]byte("before"))
+	require.NoError(t, <-done)
+	require.True(t, receiver.rekeyDue(1, time.Hour, time.Now()))
+	require.True(t, receiver.rekeyDue(100, time.Minute, time.Now().Add(time.Hour)))
+	require.False(t, receiver.rekeyDue(100, time.Hour, time.Now()))
+
+	oldKey := receiver.state.sessionKey
+	pubKey, err := receiver.beginRekey()
+	require.NoError(t, err)
+	require.False(t, receiver.rekeyDue(1, time.Hour, time.Now()), "rekey already in progress")
+
+	rekeyDone := make(chan error, 1)
+	go func() {
+		rekeyDone <- sender.rekey(pubKey, func(pubKey []byte) []byte {
+			return append([]byte("ack"), pubKey...)
+		})
+	}()
+	msg, err := receiver.Receive()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack"), msg[:3])
+	require.NoError(t, receiver.completeRekey(msg[3:]))
+	require.NoError(t, <-rekeyDone)
+
+	require.NotEqual(t, oldKey, receiver.state.sessionKey)
+	require.Equal(t, sender.state.sessionKey, receiver.state.sessionKey)
+	require.Equal(t, uint64(1), sender.rekeyCount())
+	require.Equal(t, uint64(1), receiver.rekeyCount())
+
+	done = send([]byte("after"))
+	receive([]byte("after"))
+	require.NoError(t, <-done)
+
+	require.Error(t, receiver.completeRekey(pubKey), "no rekey in progress")
+}
@@ -0,0 +1,330 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/branthz/utarrow/lib/log"
+)
+
+// ReliableUnicastConfig tunes a ReliableUnicast. Zero values select the
+// defaults.
+type ReliableUnicastConfig struct {
+	QueueSize     int           // unacknowledged msgs per destination; default 64
+	RetryInterval time.Duration // between attempts; default 1s
+	MaxAttempts   int           // before giving up; default 10
+}
+
+// ReliableUnicast sends unicasts that are acknowledged by their
+// destination, over a gossip channel of its own. Until acknowledged, msgs
+// are resent every RetryInterval, so delivery survives the loss of
+// connections and changes of route. Each msg starts with a kind byte and
+// uvarint session and msg IDs, by which the destination suppresses
+// duplicates and acknowledges receipt; the session ID, chosen at random,
+// distinguishes restarts of the sender. Data msgs go on to give, in
+// uvarint milliseconds, how long the sender may go on resending them, so
+// that the destination remembers them for as long as it needs to whatever
+// its own config.
+type ReliableUnicast struct {
+	router  *Router
+	gossip  Gossip
+	receive func(src PeerName, msg []byte) error
+	config  ReliableUnicastConfig
+	session uint64
+
+	sync.Mutex
+	nextID uint64
+	queues map[PeerName]map[uint64]*reliableMsg
+	seen   map[reliableMsgKey]time.Time // when to forget each msg received
+}
+
+type reliableMsg struct {
+	dst         PeerName
+	buf         []byte
+	attempts    int
+	nextAttempt time.Time
+	done        func(error)
+}
+
+type reliableMsgKey struct {
+	src         PeerName
+	session, id uint64
+}
+
+// maxReliableWindow caps how long a msg received is remembered, however
+// long its sender claims it may resend it.
+const maxReliableWindow = time.Hour
+
+const (
+	reliableData byte = iota
+	reliableAck
+)
+
+var (
+	errReliableQueueFull   = fmt.Errorf("too many unacknowledged msgs to destination")
+	errReliableUndelivered = fmt.Errorf("msg not acknowledged by destination")
+)
+
+// NewReliableUnicast returns a ReliableUnicast using the named gossip
+// channel, whose msgs are received by receive. Errors returned by receive
+// are logged; the msg is acknowledged regardless.
+func (router *Router) NewReliableUnicast(channelName string, receive func(src PeerName, msg []byte) error, config ReliableUnicastConfig) (*ReliableUnicast, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 64
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = time.Second
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	u := &ReliableUnicast{
+		router:  router,
+		receive: receive,
+		config:  config,
+		session: randUint64(),
+		queues:  make(map[PeerName]map[uint64]*reliableMsg),
+		seen:    make(map[reliableMsgKey]time.Time),
+	}
+	// Tracked before registering the channel, so that there is no
+	// channel without a retryLoop should the router be stopping.
+	if !router.track() {
+		return nil, errRouterStopped
+	}
+	gossip, err := router.NewGossipWithConfig(channelName, u, GossipConfig{NoPeriodicGossip: true})
+	if err != nil {
+		router.untrack()
+		return nil, err
+	}
+	u.gossip = gossip
+	go u.retryLoop()
+	return u, nil
+}
+
+// Send sends msg to dst, calling done with nil once dst acknowledges it,
+// or with an error once MaxAttempts have failed or the router stops. done
+// is called exactly once, from a goroutine of the router's, and must not
+// block. Send fails straight away if QueueSize msgs to dst are already
+// awaiting acknowledgement.
+func (u *ReliableUnicast) Send(dst PeerName, msg []byte, done func(error)) error {
+	if dst == u.router.Ourself.Name {
+		if !u.router.track() {
+			return errRouterStopped
+		}
+		go func() {
+			defer u.router.untrack()
+			u.deliver(dst, msg)
+			done(nil)
+		}()
+		return nil
+	}
+
+	u.Lock()
+	if u.queues == nil {
+		u.Unlock()
+		return errRouterStopped
+	}
+	queue, found := u.queues[dst]
+	if !found {
+		queue = make(map[uint64]*reliableMsg)
+		u.queues[dst] = queue
+	}
+	if len(queue) >= u.config.QueueSize {
+		u.Unlock()
+		return errReliableQueueFull
+	}
+	u.nextID++
+	m := &reliableMsg{
+		dst:         dst,
+		buf:         makeReliableData(u.session, u.nextID, u.window(), msg),
+		attempts:    1,
+		nextAttempt: time.Now().Add(u.config.RetryInterval),
+		done:        done,
+	}
+	queue[u.nextID] = m
+	u.Unlock()
+
+	u.attempt(m)
+	return nil
+}
+
+// attempt sends m. Failure is expected while there is no route to the
+// destination, so is left to a later attempt to remedy.
+func (u *ReliableUnicast) attempt(m *reliableMsg) {
+	if err := u.gossip.GossipUnicast(m.dst, m.buf); err != nil {
+		log.Debug("[reliable] unable to send to %s: %v", m.dst, err)
+	}
+}
+
+func (u *ReliableUnicast) retryLoop() {
+	defer u.router.untrack()
+	ticker := time.NewTicker(u.config.RetryInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			retries, failures := u.due(now)
+			for _, m := range retries {
+				u.attempt(m)
+			}
+			for _, m := range failures {
+				m.done(errReliableUndelivered)
+			}
+		case <-u.router.quit:
+			u.Lock()
+			queues := u.queues
+			u.queues = nil
+			u.Unlock()
+			for _, queue := range queues {
+				for _, m := range queue {
+					m.done(errRouterStopped)
+				}
+			}
+			return
+		}
+	}
+}
+
+// window is how long after sending a msg we may go on resending it.
+func (u *ReliableUnicast) window() time.Duration {
+	return time.Duration(u.config.MaxAttempts) * u.config.RetryInterval
+}
+
+// due returns the msgs due another attempt, and removes those that have
+// run out of attempts. It also forgets msgs received long enough ago that
+// their senders can no longer resend them.
+func (u *ReliableUnicast) due(now time.Time) (retries, failures []*reliableMsg) {
+	u.Lock()
+	defer u.Unlock()
+	for dst, queue := range u.queues {
+		for id, m := range queue {
+			switch {
+			case now.Before(m.nextAttempt):
+			case m.attempts >= u.config.MaxAttempts:
+				u.remove(dst, id)
+				failures = append(failures, m)
+			default:
+				m.attempts++
+				m.nextAttempt = now.Add(u.config.RetryInterval)
+				retries = append(retries, m)
+			}
+		}
+	}
+	for key, forget := range u.seen {
+		if now.After(forget) {
+			delete(u.seen, key)
+		}
+	}
+	return
+}
+
+// remove forgets the msg to dst with id. Must hold the lock.
+func (u *ReliableUnicast) remove(dst PeerName, id uint64) {
+	queue := u.queues[dst]
+	delete(queue, id)
+	if len(queue) == 0 {
+		delete(u.queues, dst)
+	}
+}
+
+func makeReliableMsg(kind byte, session, id uint64, payload []byte) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+len(payload))
+	buf[0] = kind
+	n := 1 + binary.PutUvarint(buf[1:], session)
+	n += binary.PutUvarint(buf[n:], id)
+	return append(buf[:n], payload...)
+}
+
+func makeReliableData(session, id uint64, window time.Duration, msg []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(msg))
+	n := binary.PutUvarint(buf, uint64(window/time.Millisecond))
+	return makeReliableMsg(reliableData, session, id, append(buf[:n], msg...))
+}
+
+func (u *ReliableUnicast) deliver(src PeerName, msg []byte) {
+	if err := u.receive(src, msg); err != nil {
+		log.Info("[reliable] error receiving from %s: %v", src, err)
+	}
+}
+
+// OnGossipUnicast implements Gossiper.
+func (u *ReliableUnicast) OnGossipUnicast(src PeerName, msg []byte) error {
+	if len(msg) < 1 {
+		return fmt.Errorf("empty reliable msg from %s", src)
+	}
+	session, n := binary.Uvarint(msg[1:])
+	if n <= 0 {
+		return fmt.Errorf("malformed reliable msg from %s", src)
+	}
+	id, m := binary.Uvarint(msg[1+n:])
+	if m <= 0 {
+		return fmt.Errorf("malformed reliable msg from %s", src)
+	}
+	kind, payload := msg[0], msg[1+n+m:]
+
+	switch kind {
+	case reliableData:
+		millis, k := binary.Uvarint(payload)
+		if k <= 0 {
+			return fmt.Errorf("malformed reliable msg from %s", src)
+		}
+		payload = payload[k:]
+		// Twice the sender's window, to allow for msgs held up on the way.
+		window := maxReliableWindow
+		if millis < uint64(maxReliableWindow/time.Millisecond)/2 {
+			window = 2 * time.Duration(millis) * time.Millisecond
+		}
+		key := reliableMsgKey{src, session, id}
+		u.Lock()
+		_, duplicate := u.seen[key]
+		if !duplicate {
+			u.seen[key] = time.Now().Add(window)
+		}
+		u.Unlock()
+		if !duplicate {
+			u.deliver(src, payload)
+		}
+		// Acknowledge even duplicates, in case the earlier ack was lost.
+		if err := u.gossip.GossipUnicast(src, makeReliableMsg(reliableAck, session, id, nil)); err != nil {
+			log.Debug("[reliable] unable to acknowledge %s: %v", src, err)
+		}
+		return nil
+	case reliableAck:
+		if session != u.session {
+			return nil // for a previous incarnation of ours
+		}
+		u.Lock()
+		m, found := u.queues[src][id]
+		if found {
+			u.remove(src, id)
+		}
+		u.Unlock()
+		if found {
+			m.done(nil)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown reliable msg kind %d from %s", kind, src)
+}
+
+// OnGossipBroadcast implements Gossiper. A ReliableUnicast does not
+// broadcast, but a broadcast is only logged, since an error would break
+// the connection it arrived on.
+func (u *ReliableUnicast) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	log.Info("[reliable] ignoring unexpected broadcast from %s", src)
+	return nil, nil
+}
+
+// Gossip implements Gossiper. A ReliableUnicast has no state to gossip.
+func (u *ReliableUnicast) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper. A ReliableUnicast does not gossip, but as
+// for OnGossipBroadcast, gossip is only logged.
+func (u *ReliableUnicast) OnGossip(msg []byte) (GossipData, error) {
+	log.Info("[reliable] ignoring unexpected gossip")
+	return nil, nil
+}
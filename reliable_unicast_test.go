@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReliableUnicast(t *testing.T) {
+	network := NewMemTransport()
+	config := ReliableUnicastConfig{QueueSize: 2, RetryInterval: 20 * time.Millisecond, MaxAttempts: 50}
+	type receipt struct {
+		src PeerName
+		msg string
+	}
+	received := make(chan receipt, 10)
+	var routers []*Router
+	var unicasts []*ReliableUnicast
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		unicast, err := router.NewReliableUnicast("reliable", func(src PeerName, msg []byte) error {
+			received <- receipt{src, string(msg)}
+			return nil
+		}, config)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, unicasts = append(routers, router), append(unicasts, unicast)
+	}
+	r1, r2 := routers[0], routers[1]
+	defer r2.Stop(context.Background())
+	results := make(chan error, 10)
+	done := func(err error) { results <- err }
+
+	// Sent before there is any route, so delivered by a retry.
+	require.NoError(t, unicasts[0].Send(r2.Ourself.Name, []byte("early"), done))
+	require.NoError(t, unicasts[0].Send(r2.Ourself.Name, []byte("early too"), done))
+	require.Equal(t, errReliableQueueFull, unicasts[0].Send(r2.Ourself.Name, []byte("one too many"), done))
+
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	require.NoError(t, <-results)
+	require.NoError(t, <-results)
+	msgs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		r := <-received
+		require.Equal(t, r1.Ourself.Name, r.src)
+		msgs[r.msg] = true
+	}
+	require.Equal(t, map[string]bool{"early": true, "early too": true}, msgs)
+
+	require.NoError(t, unicasts[1].Send(r1.Ourself.Name, []byte("reply"), done))
+	require.NoError(t, <-results)
+	require.Equal(t, receipt{r2.Ourself.Name, "reply"}, <-received)
+
+	require.NoError(t, unicasts[0].Send(r1.Ourself.Name, []byte("self"), done))
+	require.NoError(t, <-results)
+	require.Equal(t, receipt{r1.Ourself.Name, "self"}, <-received)
+
+	unknown, _ := PeerNameFromString("ff:00:00:00:00:01")
+	require.NoError(t, unicasts[0].Send(unknown, []byte("lost"), done))
+	require.Equal(t, errReliableUndelivered, <-results)
+
+	require.NoError(t, unicasts[0].Send(unknown, []byte("stopped"), done))
+	require.NoError(t, r1.Stop(context.Background()))
+	require.Equal(t, errRouterStopped, <-results)
+	require.Equal(t, errRouterStopped, unicasts[0].Send(unknown, []byte("after stop"), done))
+
+	select {
+	case r := <-received:
+		require.FailNow(t, "duplicate delivery", "%v", r)
+	default:
+	}
+}
+
+func TestReliableUnicastWindow(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:00:00:01")
+	router, err := NewRouter(Config{Host: "10.0.0.1", Port: Port, Transport: NewMemTransport()}, name, "1", nil)
+	require.NoError(t, err)
+	defer router.Stop(context.Background())
+	received := 0
+	u, err := router.NewReliableUnicast("reliable", func(src PeerName, msg []byte) error {
+		received++
+		return nil
+	}, ReliableUnicastConfig{RetryInterval: time.Millisecond, MaxAttempts: 1})
+	require.NoError(t, err)
+	src, _ := PeerNameFromString("02:00:00:00:00:01")
+
+	// The sender's window holds, not our much shorter one.
+	msg := makeReliableData(1, 1, time.Minute, []byte("hello"))
+	require.NoError(t, u.OnGossipUnicast(src, msg))
+	u.due(time.Now().Add(time.Second))
+	require.NoError(t, u.OnGossipUnicast(src, msg))
+	require.Equal(t, 1, received)
+
+	u.due(time.Now().Add(3 * time.Minute))
+	require.NoError(t, u.OnGossipUnicast(src, msg))
+	require.Equal(t, 2, received)
+
+	_, err = u.OnGossipBroadcast(src, []byte("broadcast"))
+	require.NoError(t, err, "stray gossip should not break the connection")
+}
@@ -2,7 +2,7 @@ package mesh
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
 	"math"
 	"net"
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/branthz/utarrow/lib/log"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
@@ -21,6 +22,11 @@ var (
 	ChannelSize = 16
 
 	defaultGossipInterval = 30 * time.Second
+	defaultRekeyInterval  = time.Hour
+	defaultRekeyMessages  = uint64(1 << 24)
+
+	errRouterStarted = fmt.Errorf("router already started")
+	errRouterStopped = fmt.Errorf("router stopped")
 )
 
 const (
@@ -36,11 +42,68 @@ type Config struct {
 	Host               string
 	Port               int
 	Password           []byte
+	Passwords          [][]byte // accepted from remotes besides Password; see SetPasswords
 	ConnLimit          int
 	ProtocolMinVersion byte
 	PeerDiscovery      bool
 	TrustedSubnets     []*net.IPNet
 	GossipInterval     *time.Duration
+	Transport          Transport // defaults to TCPTransport
+
+	// Identity is our long-term key. When set, we prove possession of it
+	// to every remote during the protocol intro.
+	Identity ed25519.PrivateKey
+
+	// AllowedPeers, when set, admits only remotes which prove
+	// possession of an identity key it approves. See AllowPeerKeys. The
+	// proof is bound to a key exchange, and the connection encrypted
+	// with the key agreed, password or not, so that an approved peer
+	// cannot be impersonated after the intro.
+	AllowedPeers func(name PeerName, key ed25519.PublicKey) bool
+
+	// RekeyInterval and RekeyMessages bound how long, and for how many
+	// msgs, each direction of an encrypted connection uses a session key
+	// before it is replaced with one from a fresh key exchange. Zero
+	// selects the default. As the check is made on receipt, heartbeats
+	// limit how late a rekey can be.
+	RekeyInterval time.Duration
+	RekeyMessages uint64
+
+	// CompressionThreshold is the size from which msgs are compressed,
+	// on connections to remotes supporting it. Zero selects the default;
+	// a negative value disables compression.
+	CompressionThreshold int
+
+	// MaxMessageSize is the ceiling on the size of protocol msgs, e.g.
+	// encoded GossipData, which are chunked if too large for a single
+	// frame. Zero selects the default; it is never less than a single
+	// frame.
+	MaxMessageSize int
+
+	// GossipQueueBytes bounds the gossip queued for each connection,
+	// across all channels, yet to be sent. Zero for no bound. Gossip over
+	// the bound is dealt with by its channel's GossipQueuePolicy. Topology
+	// gossip is exempt.
+	GossipQueueBytes int
+
+	// PhiThreshold, when positive, is the suspicion that the remote has
+	// failed, as estimated from the arrival times of its heartbeats and
+	// other msgs, at which a connection is torn down rather than waiting
+	// for it to time out. 8 is reasonable; see LocalConnectionStatus.Phi.
+	PhiThreshold float64
+}
+
+// AllowPeerKeys returns an AllowedPeers function admitting only the peers
+// named in keys, each holding the identity key given for it.
+func AllowPeerKeys(keys map[PeerName]ed25519.PublicKey) func(PeerName, ed25519.PublicKey) bool {
+	allowed := make(map[PeerName]ed25519.PublicKey, len(keys))
+	for name, key := range keys {
+		allowed[name] = key
+	}
+	return func(name PeerName, key ed25519.PublicKey) bool {
+		allowedKey, found := allowed[name]
+		return found && bytes.Equal(allowedKey, key)
+	}
 }
 
 // Router manages communication between this peer and the rest of the mesh.
@@ -54,27 +117,49 @@ type Router struct {
 	ConnectionMaker *connectionMaker
 	gossipLock      sync.RWMutex
 	gossipChannels  gossipChannels
+	closedChannels  map[string]struct{} // closed without relaying; see CloseGossip
 	topologyGossip  Gossip
 	acceptLimiter   *tokenBucket
+	passwordLock    sync.RWMutex
+	passwords       [][]byte // current password first
+	listener        net.Listener
+
+	subscriptionsLock sync.Mutex
+	subscriptions     map[*Subscription]struct{}
+
+	// Guards the following, which mostly track everything that must
+	// finish before Stop returns.
+	stopLock   sync.Mutex
+	stopped    bool
+	quit       chan struct{} // closed when stopped is set
+	localConns map[*LocalConnection]struct{}
+	workers    sync.WaitGroup
+	acceptErr  error // why we stopped accepting while running, if we have
 }
 
 // NewRouter returns a new router. It must be started.
 func NewRouter(config Config, name PeerName, nickName string, overlay Overlay) (*Router, error) {
-	router := &Router{Config: config, gossipChannels: make(gossipChannels)}
+	router := &Router{Config: config, gossipChannels: make(gossipChannels), closedChannels: make(map[string]struct{}), subscriptions: make(map[*Subscription]struct{}), localConns: make(map[*LocalConnection]struct{}), quit: make(chan struct{})}
 
 	if overlay == nil {
 		overlay = NullOverlay{}
 	}
 
 	router.Overlay = overlay
+	router.SetPasswords(config.Password, config.Passwords...)
 	router.Ourself = newLocalPeer(name, nickName, router)
 	router.Peers = newPeers(router.Ourself)
 	router.Peers.OnGC(func(peer *Peer) {
 		log.Info("Removed unreachable peer %s", peer)
+		router.publish(MembershipEvent{Type: PeerLeft, Peer: peer.Name, UID: peer.UID})
 	})
+	router.Peers.onMembership(router.publish)
 	router.Routes = newRoutes(router.Ourself, router.Peers)
+	router.Routes.OnChange(func() {
+		router.publish(MembershipEvent{Type: RoutesChanged})
+	})
 	router.ConnectionMaker = newConnectionMaker(router.Ourself, router.Peers, net.JoinHostPort(router.Host, "0"), router.Port, router.PeerDiscovery)
-	gossip, err := router.NewGossip("topology", router)
+	gossip, err := router.newGossip("topology", router, GossipConfig{Priority: gossipPriorityTopology})
 	if err != nil {
 		return nil, err
 	}
@@ -83,67 +168,386 @@ func NewRouter(config Config, name PeerName, nickName string, overlay Overlay) (
 	return router, nil
 }
 
-// Start listening for TCP connections. This is separate from NewRouter so
-// that gossipers can register before we start forming connections.
-func (router *Router) Start() {
-	router.listenTCP()
+// Start listening for connections on Host:Port, using the configured
+// Transport. This is separate from NewRouter so that gossipers can register
+// before we start forming connections. It returns an error if the address
+// cannot be bound.
+func (router *Router) Start() error {
+	if router.isStopped() {
+		return errRouterStopped
+	}
+	ln, err := router.transport().Listen(net.JoinHostPort(router.Host, fmt.Sprint(router.Port)))
+	if err != nil {
+		return err
+	}
+	if err := router.StartWithListener(ln); err != nil {
+		ln.Close()
+		return err
+	}
+	return nil
 }
 
-// Stop shuts down the router.
-func (router *Router) Stop() error {
-	router.Overlay.Stop()
-	// TODO: perform more graceful shutdown...
+// StartWithListener is like Start, but accepts connections from a listener
+// supplied by the caller, e.g. one inherited through socket activation, or
+// bound to an ephemeral port. The router takes ownership of ln, and closes
+// it when stopped.
+func (router *Router) StartWithListener(ln net.Listener) error {
+	router.stopLock.Lock()
+	switch {
+	case router.stopped:
+		router.stopLock.Unlock()
+		return errRouterStopped
+	case router.listener != nil:
+		router.stopLock.Unlock()
+		return errRouterStarted
+	}
+	router.listener = ln
+	router.workers.Add(1)
+	go router.acceptLoop(ln)
+	router.stopLock.Unlock()
+
+	// The port may have been unknown until now, e.g. with a Port of 0.
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && addr.Port != 0 {
+		router.ConnectionMaker.setPort(addr.Port)
+	}
 	return nil
 }
 
-func (router *Router) usingPassword() bool {
-	return router.Password != nil
+// Addr returns the address the router is listening on, or nil if it has
+// not been started.
+func (router *Router) Addr() net.Addr {
+	router.stopLock.Lock()
+	defer router.stopLock.Unlock()
+	if router.listener == nil {
+		return nil
+	}
+	return router.listener.Addr()
 }
 
-func (router *Router) listenTCP() {
-	localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(router.Host, fmt.Sprint(router.Port)))
-	if err != nil {
-		panic(err)
+// Stop shuts down the router. It stops accepting and making connections,
+// sends any pending gossip, says goodbye to our neighbours so that they
+// update their topology immediately, and then waits for all of the router's
+// goroutines to finish. If ctx is done before that, Stop returns ctx.Err()
+// and the remaining goroutines finish in the background.
+func (router *Router) Stop(ctx context.Context) error {
+	router.stopLock.Lock()
+	if router.stopped {
+		router.stopLock.Unlock()
+		return nil
 	}
-	ln, err := net.ListenTCP("tcp", localAddr)
-	if err != nil {
-		panic(err)
+	router.stopped = true
+	close(router.quit)
+	ln := router.listener
+	conns := make([]*LocalConnection, 0, len(router.localConns))
+	for conn := range router.localConns {
+		conns = append(conns, conn)
 	}
+	router.stopLock.Unlock()
+
+	if ln != nil {
+		if err := ln.Close(); err != nil {
+			log.Info("warning: %v", err)
+		}
+	}
+	for _, conn := range conns {
+		conn.senders.drain(ctx)
+	}
+	for _, conn := range conns {
+		conn.shutdown(errRouterStopped)
+	}
+
+	finished := make(chan struct{})
 	go func() {
-		defer ln.Close()
-		for {
-			tcpConn, err := ln.AcceptTCP()
-			if err != nil {
+		router.workers.Wait()
+		// Ourself first, since its actions may wait on the
+		// ConnectionMaker's.
+		router.Ourself.stop()
+		router.ConnectionMaker.stop()
+		router.Routes.stop()
+		router.Peers.stop()
+		router.Overlay.Stop()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers a goroutine that Stop must wait for, returning false if
+// the router is already stopping.
+func (router *Router) track() bool {
+	return router.trackN(1)
+}
+
+// trackN is track, for n goroutines at once.
+func (router *Router) trackN(n int) bool {
+	router.stopLock.Lock()
+	defer router.stopLock.Unlock()
+	if router.stopped {
+		return false
+	}
+	router.workers.Add(n)
+	return true
+}
+
+func (router *Router) untrack() {
+	router.workers.Done()
+}
+
+func (router *Router) addLocalConnection(conn *LocalConnection) bool {
+	router.stopLock.Lock()
+	defer router.stopLock.Unlock()
+	if router.stopped {
+		return false
+	}
+	router.localConns[conn] = struct{}{}
+	router.workers.Add(1)
+	return true
+}
+
+func (router *Router) removeLocalConnection(conn *LocalConnection) {
+	router.stopLock.Lock()
+	delete(router.localConns, conn)
+	router.stopLock.Unlock()
+	router.workers.Done()
+}
+
+// SetPasswords changes the passwords of subsequent connections. We encrypt
+// with current, and accept remotes encrypting with current or any of
+// previous. So a new password can be rolled out across a live mesh by first
+// adding it to previous on every peer, then making it current on every
+// peer, and finally dropping the old one. Existing connections are
+// unaffected. A nil current disables encryption.
+func (router *Router) SetPasswords(current []byte, previous ...[]byte) {
+	passwords := [][]byte{current}
+	if current != nil {
+		passwords = append(passwords, previous...)
+	}
+	router.passwordLock.Lock()
+	router.passwords = passwords
+	router.passwordLock.Unlock()
+}
+
+// getPasswords returns the current password, and the others accepted.
+func (router *Router) getPasswords() ([]byte, [][]byte) {
+	router.passwordLock.RLock()
+	defer router.passwordLock.RUnlock()
+	return router.passwords[0], router.passwords[1:]
+}
+
+func (router *Router) rekeyInterval() time.Duration {
+	if router.RekeyInterval > 0 {
+		return router.RekeyInterval
+	}
+	return defaultRekeyInterval
+}
+
+func (router *Router) rekeyMessages() uint64 {
+	if router.RekeyMessages > 0 {
+		return router.RekeyMessages
+	}
+	return defaultRekeyMessages
+}
+
+func (router *Router) compressionThreshold() int {
+	if router.CompressionThreshold != 0 {
+		return router.CompressionThreshold
+	}
+	return defaultCompressionThreshold
+}
+
+func (router *Router) maxMessageSize() int {
+	switch {
+	case router.MaxMessageSize <= 0:
+		return defaultMaxMessageSize
+	case router.MaxMessageSize < maxUnchunkedMsgSize:
+		return maxUnchunkedMsgSize
+	}
+	return router.MaxMessageSize
+}
+
+func (router *Router) usingPassword() bool {
+	current, _ := router.getPasswords()
+	return current != nil
+}
+
+func (router *Router) acceptLoop(ln net.Listener) {
+	defer router.untrack()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if router.isStopped() {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				log.Debug("%v", err)
 				continue
 			}
-			router.acceptTCP(tcpConn)
-			router.acceptLimiter.wait()
+			// Not of our doing, as Stop sets stopped before closing ln.
+			log.Error("no longer accepting connections: %v", err)
+			router.stopLock.Lock()
+			router.acceptErr = err
+			router.stopLock.Unlock()
+			return
 		}
-	}()
+		router.accept(conn)
+		router.acceptLimiter.wait()
+	}
+}
+
+// acceptError returns why the router stopped accepting connections while
+// still running, if it has.
+func (router *Router) acceptError() error {
+	router.stopLock.Lock()
+	defer router.stopLock.Unlock()
+	return router.acceptErr
+}
+
+func (router *Router) isStopped() bool {
+	router.stopLock.Lock()
+	defer router.stopLock.Unlock()
+	return router.stopped
 }
 
-func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
-	remoteAddrStr := tcpConn.RemoteAddr().String()
+func (router *Router) accept(netConn net.Conn) {
+	remoteAddrStr := netConn.RemoteAddr().String()
 	log.Debug("->[%s] connection accepted", remoteAddrStr)
 	connRemote := newRemoteConnection(router.Ourself.Peer, nil, remoteAddrStr, false, false)
-	startLocalConnection(connRemote, tcpConn, router, true)
+	startLocalConnection(connRemote, netConn, router, true)
+}
+
+// GossipConfig tunes a gossip channel. Zero values select the defaults.
+type GossipConfig struct {
+	// CausalBroadcast delivers broadcasts to OnGossipBroadcast in causal
+	// order, and without merging them. Every peer on the channel must
+	// set it. See causalGossip.
+	CausalBroadcast bool
+
+	// CausalHistory is how many of its latest broadcasts a peer keeps
+	// for retransmission, with CausalBroadcast; default 1024.
+	CausalHistory int
+
+	// Interval is how often the channel's state, or its digest, is
+	// gossiped to random neighbours; default Config.GossipInterval.
+	Interval time.Duration
+
+	// Fanout is how many random neighbours gossip is sent to; default
+	// twice the base 2 logarithm of the number of peers.
+	Fanout int
+
+	// NoPeriodicGossip turns periodic gossip off. State is still
+	// gossiped down new connections.
+	NoPeriodicGossip bool
+
+	// QueueBytes bounds the channel's gossip queued for each connection,
+	// yet to be sent. Zero for no bound. QueuePolicy deals with gossip
+	// over this bound, or over Config.GossipQueueBytes.
+	QueueBytes  int
+	QueuePolicy GossipQueuePolicy
+
+	// Priority is the channel's share of the bandwidth of connections;
+	// see GossipPriority.
+	Priority GossipPriority
 }
 
 // NewGossip returns a usable GossipChannel from the router.
 //
 // TODO(pb): rename?
 func (router *Router) NewGossip(channelName string, g Gossiper) (Gossip, error) {
+	return router.NewGossipWithConfig(channelName, g, GossipConfig{})
+}
+
+// NewGossipWithConfig is NewGossip, with the channel tuned by config.
+func (router *Router) NewGossipWithConfig(channelName string, g Gossiper, config GossipConfig) (Gossip, error) {
+	if config.Priority < 0 || config.Priority > GossipPriorityBulk {
+		return nil, fmt.Errorf("[gossip] invalid priority %d for channel %s", config.Priority, channelName)
+	}
+	return router.newGossip(channelName, g, config)
+}
+
+// newGossip is NewGossipWithConfig, without limiting the priority to the
+// classes open to the application.
+func (router *Router) newGossip(channelName string, g Gossiper, config GossipConfig) (Gossip, error) {
+	var causal *causalGossip
+	if config.CausalBroadcast {
+		causal = newCausalGossip(router, g, config.CausalHistory)
+		g = causal
+	}
 	channel := newGossipChannel(channelName, router.Ourself, router.Routes, g)
+	channel.fanout = config.Fanout
+	channel.queueLimit, channel.queuePolicy = config.QueueBytes, config.QueuePolicy
+	channel.priority = config.Priority
+	interval := config.Interval
+	if interval <= 0 {
+		interval = router.gossipInterval()
+	}
+	workers := 0
+	if !config.NoPeriodicGossip {
+		workers++
+	}
+	if causal != nil {
+		workers++
+	}
 	router.gossipLock.Lock()
 	defer router.gossipLock.Unlock()
 	if _, found := router.gossipChannels[channelName]; found {
 		return nil, fmt.Errorf("[gossip] duplicate channel %s", channelName)
 	}
+	// The channel's goroutines are tracked before it is registered, so
+	// that, should the router be stopping, it is not registered at all.
+	if !router.trackN(workers) {
+		return nil, errRouterStopped
+	}
 	router.gossipChannels[channelName] = channel
-	return channel, nil
+	delete(router.closedChannels, channelName)
+	if !config.NoPeriodicGossip {
+		go channel.gossipLoop(interval, router.quit)
+	}
+	if causal == nil {
+		return channel, nil
+	}
+	causal.gossip = channel
+	causal.quit = channel.quit
+	go causal.retryLoop()
+	return causal, nil
+}
+
+// CloseGossip unregisters the named channel. Its periodic gossip stops,
+// what its senders have yet to send is discarded, and the Gossip returned
+// for it sends nothing more. Msgs arriving for the channel afterwards are
+// relayed if relay is set, as for any channel we do not have, and dropped
+// otherwise. The channel may be registered afresh with NewGossip.
+func (router *Router) CloseGossip(channelName string, relay bool) error {
+	router.gossipLock.Lock()
+	channel, found := router.gossipChannels[channelName]
+	switch {
+	case !found:
+		router.gossipLock.Unlock()
+		return fmt.Errorf("[gossip] unknown channel %s", channelName)
+	case Gossip(channel) == router.topologyGossip:
+		router.gossipLock.Unlock()
+		return fmt.Errorf("[gossip] cannot close channel %s", channelName)
+	}
+	delete(router.gossipChannels, channelName)
+	if !relay {
+		router.closedChannels[channelName] = struct{}{}
+	}
+	// Once stopped, the channel makes no more senders, and with the lock
+	// held, no channel of the same name can make any before its senders
+	// are removed.
+	channel.stop()
+	for conn := range router.Ourself.getConnections() {
+		conn.(gossipConnection).gossipSenders().remove(channelName)
+	}
+	router.gossipLock.Unlock()
+	return nil
 }
 
+// gossipChannel returns the named channel, creating a surrogate if we do
+// not have it, or nil if it was closed without relaying.
 func (router *Router) gossipChannel(channelName string) *gossipChannel {
 	router.gossipLock.RLock()
 	channel, found := router.gossipChannels[channelName]
@@ -156,6 +560,9 @@ func (router *Router) gossipChannel(channelName string) *gossipChannel {
 	if channel, found = router.gossipChannels[channelName]; found {
 		return channel
 	}
+	if _, closed := router.closedChannels[channelName]; closed {
+		return nil
+	}
 	channel = newGossipChannel(channelName, router.Ourself, router.Routes, &surrogateGossiper{router: router})
 	channel.logf("created surrogate channel")
 	router.gossipChannels[channelName] = channel
@@ -180,43 +587,43 @@ func (router *Router) gossipInterval() time.Duration {
 	}
 }
 
-func (router *Router) handleGossip(tag protocolTag, payload []byte) error {
-	decoder := gob.NewDecoder(bytes.NewReader(payload))
-	var channelName string
-	if err := decoder.Decode(&channelName); err != nil {
-		return err
+func (router *Router) transport() Transport {
+	if router.Config.Transport != nil {
+		return router.Config.Transport
 	}
-	channel := router.gossipChannel(channelName)
-	var srcName PeerName
-	if err := decoder.Decode(&srcName); err != nil {
+	return TCPTransport{}
+}
+
+func (router *Router) handleGossip(codec gossipCodec, tag protocolTag, payload []byte) error {
+	m, err := codec.decode(tag, payload)
+	if err != nil {
 		return err
 	}
+	channel := router.gossipChannel(m.channelName)
+	if channel == nil {
+		return nil
+	}
 	switch tag {
 	case ProtocolGossipUnicast:
-		return channel.deliverUnicast(srcName, payload, decoder)
+		return channel.deliverUnicast(m)
 	case ProtocolGossipBroadcast:
-		return channel.deliverBroadcast(srcName, payload, decoder)
+		return channel.deliverBroadcast(m.srcName, m.payload)
 	case ProtocolGossip:
-		return channel.deliver(srcName, payload, decoder)
+		return channel.deliver(m.srcName, m.payload)
+	case ProtocolGossipQuery:
+		return channel.deliverQuery(m)
+	case ProtocolGossipQueryReply:
+		return channel.deliverQueryReply(m)
+	case ProtocolGossipDigest:
+		return channel.deliverDigest(m.srcName, m.payload)
 	}
 	return nil
 }
 
-// Relay all pending gossip data for each channel via random neighbours.
-func (router *Router) sendAllGossip() {
-	for channel := range router.gossipChannelSet() {
-		if gossip := channel.gossiper.Gossip(); gossip != nil {
-			channel.Send(gossip)
-		}
-	}
-}
-
-// Relay all pending gossip data for each channel via conn.
+// Relay all pending gossip data, or its digest, for each channel via conn.
 func (router *Router) sendAllGossipDown(conn Connection) {
 	for channel := range router.gossipChannelSet() {
-		if gossip := channel.gossiper.Gossip(); gossip != nil {
-			channel.SendDown(conn, gossip)
-		}
+		channel.sendGossipDown(conn)
 	}
 }
 
@@ -288,7 +695,6 @@ func (router *Router) trusts(remote *remoteConnection) bool {
 			}
 		}
 	} else {
-		// Should not happen as remoteTCPAddr was obtained from TCPConn
 		log.Debug("Unable to parse remote TCP addr: %s", err)
 	}
 	return false
@@ -0,0 +1,215 @@
+package mesh
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newTCPTestRouter(t *testing.T, name string) *Router {
+	peerName, err := PeerNameFromString(name)
+	require.NoError(t, err)
+	router, err := NewRouter(Config{Host: "127.0.0.1"}, peerName, name, nil)
+	require.NoError(t, err)
+	require.NoError(t, router.Start())
+	return router
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "timed out waiting for "+what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouterStop(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00")
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "connection", func() bool { return r2.Ourself.connectionCount() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, r1.Stop(ctx))
+
+	// r2 should learn of our departure from the goodbye, well before
+	// any heartbeat would time out.
+	waitFor(t, "goodbye", func() bool { return r2.Ourself.connectionCount() == 0 })
+
+	require.NoError(t, r2.Stop(ctx))
+	require.NoError(t, r1.Stop(ctx), "Stop should be idempotent")
+	waitFor(t, "goroutines to exit", func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+func TestRouterStartErrors(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop(context.Background())
+	require.Equal(t, errRouterStarted, r1.Start())
+
+	// Binding the port r1 already holds must fail rather than panic.
+	port := r1.Addr().(*net.TCPAddr).Port
+	peerName, _ := PeerNameFromString("02:00:00:02:00:00")
+	r2, err := NewRouter(Config{Host: "127.0.0.1", Port: port}, peerName, "r2", nil)
+	require.NoError(t, err)
+	require.Error(t, r2.Start())
+	require.Nil(t, r2.Addr())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, r2.StartWithListener(ln))
+	require.Equal(t, ln.Addr(), r2.Addr())
+	require.NoError(t, r2.Stop(context.Background()))
+	require.Equal(t, errRouterStopped, r2.Start())
+}
+
+func TestRouterAcceptError(t *testing.T) {
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	r1, err := NewRouter(Config{}, peerName, "r1", nil)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, r1.StartWithListener(ln))
+	require.Empty(t, NewStatus(r1).AcceptError)
+
+	// Closed from under the router, rather than by Stop.
+	require.NoError(t, ln.Close())
+	waitFor(t, "accept error", func() bool { return NewStatus(r1).AcceptError != "" })
+	require.NoError(t, r1.Stop(context.Background()))
+}
+
+func TestRouterEphemeralPort(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop(context.Background())
+	// A target without a port is completed with the one we bound.
+	r1.ConnectionMaker.InitiateConnections([]string{"127.0.0.1"}, true)
+	waitFor(t, "target", func() bool {
+		for _, conn := range makeLocalConnectionStatusSlice(r1.ConnectionMaker) {
+			if conn.Address == r1.Addr().String() {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestRouterAllowedPeers(t *testing.T) {
+	network := NewMemTransport()
+	newRouter := func(host, name string, identity ed25519.PrivateKey, allowed func(PeerName, ed25519.PublicKey) bool) *Router {
+		peerName, err := PeerNameFromString(name)
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: host, Port: Port, Transport: network, Identity: identity, AllowedPeers: allowed}, peerName, host, nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		return router
+	}
+	pub1, priv1, _ := ed25519.GenerateKey(nil)
+	_, priv2, _ := ed25519.GenerateKey(nil)
+	_, priv3, _ := ed25519.GenerateKey(nil)
+
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	r2 := newRouter("10.0.0.2", "02:00:00:02:00:00", priv2, AllowPeerKeys(map[PeerName]ed25519.PublicKey{name1: pub1}))
+	r1 := newRouter("10.0.0.1", "01:00:00:01:00:00", priv1, nil)
+	r3 := newRouter("10.0.0.3", "03:00:00:03:00:00", priv3, nil)
+	r4 := newRouter("10.0.0.4", "04:00:00:04:00:00", nil, nil)
+	// r5 holds r1's key, but not its name
+	r5 := newRouter("10.0.0.5", "05:00:00:05:00:00", priv1, nil)
+	defer func() {
+		for _, router := range []*Router{r1, r2, r3, r4, r5} {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "allowed connection", func() bool { return r2.Ourself.connectionCount() == 1 })
+	for _, conn := range makeLocalConnectionStatusSlice(r2.ConnectionMaker) {
+		require.True(t, strings.HasPrefix(conn.Info, "encrypted"), conn.Info)
+	}
+
+	r3.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	r4.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	r5.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "rejections", func() bool { return terminationCount(r2) >= 3 })
+	require.Equal(t, 1, r2.Ourself.connectionCount())
+}
+
+func TestRouterPasswordRotation(t *testing.T) {
+	network := NewMemTransport()
+	newRouter := func(host, name string, password []byte, previous ...[]byte) *Router {
+		peerName, err := PeerNameFromString(name)
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: host, Port: Port, Transport: network, Password: password, Passwords: previous}, peerName, host, nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		return router
+	}
+	oldPassword, newPassword := []byte("old password"), []byte("new password")
+
+	// r1 has switched to the new password; r2 has only learnt of it.
+	r1 := newRouter("10.0.0.1", "01:00:00:01:00:00", newPassword, oldPassword)
+	r2 := newRouter("10.0.0.2", "02:00:00:02:00:00", oldPassword, newPassword)
+	r3 := newRouter("10.0.0.3", "03:00:00:03:00:00", []byte("other password"))
+	defer func() {
+		for _, router := range []*Router{r1, r2, r3} {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "connection", func() bool { return r2.Ourself.connectionCount() == 1 })
+	require.Equal(t, 2, NewStatus(r2).Passwords)
+	waitFor(t, "established", func() bool {
+		conns := NewStatus(r2).Connections
+		return len(conns) == 1 && conns[0].State == "established"
+	})
+	require.Equal(t, 1, NewStatus(r2).Connections[0].PasswordIndex)
+	require.Equal(t, 1, NewStatus(r1).Connections[0].PasswordIndex)
+
+	r3.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "rejection", func() bool { return terminationCount(r2) >= 1 })
+
+	// Once r3 uses a password r2 accepts, it can connect.
+	r3.SetPasswords(oldPassword, []byte("other password"))
+	r3.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "connection after rotation", func() bool { return r2.Ourself.connectionCount() == 2 })
+}
+
+func TestRouterRekey(t *testing.T) {
+	network := NewMemTransport()
+	newRouter := func(host, name string) *Router {
+		peerName, err := PeerNameFromString(name)
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: host, Port: Port, Transport: network, Password: []byte("sekr1t"), RekeyMessages: 1}, peerName, host, nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		return router
+	}
+	r1 := newRouter("10.0.0.1", "01:00:00:01:00:00")
+	r2 := newRouter("10.0.0.2", "02:00:00:02:00:00")
+	defer func() {
+		for _, router := range []*Router{r1, r2} {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	rekeyed := func(router *Router) func() bool {
+		return func() bool {
+			conns := NewStatus(router).Connections
+			return len(conns) == 1 && conns[0].SendRekeys >= 2 && conns[0].ReceiveRekeys >= 2
+		}
+	}
+	waitFor(t, "r1 rekeys", rekeyed(r1))
+	waitFor(t, "r2 rekeys", rekeyed(r2))
+	require.Equal(t, 1, r2.Ourself.connectionCount())
+}
@@ -3,6 +3,7 @@ package mesh
 import (
 	"math"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,6 +25,8 @@ type routes struct {
 	pendingRecalc bool
 	wait          chan chan struct{}
 	action        chan<- func()
+	quit          chan struct{}
+	finished      chan struct{} // closed to signal that run has finished
 	// [1] based on *all* connections, not just established &
 	// symmetric ones
 }
@@ -48,6 +51,8 @@ func newRoutes(ourself *localPeer, peers *Peers) *routes {
 		recalcTimer:  time.NewTimer(time.Hour),
 		wait:         wait,
 		action:       action,
+		quit:         make(chan struct{}),
+		finished:     make(chan struct{}),
 	}
 	r.recalcTimer.Stop()
 	go r.run(wait, action)
@@ -55,7 +60,7 @@ func newRoutes(ourself *localPeer, peers *Peers) *routes {
 }
 
 // OnChange appends callback to the functions that will be called whenever the
-// routes are recalculated.
+// routes are recalculated and found to have changed.
 func (r *routes) OnChange(callback func()) {
 	r.Lock()
 	defer r.Unlock()
@@ -107,7 +112,7 @@ func (r *routes) lookupOrCalculate(name PeerName, broadcast *broadcastRoutes, es
 		return hops
 	}
 	res := make(chan []PeerName)
-	r.action <- func() {
+	action := func() {
 		r.RLock()
 		hops, found := (*broadcast)[name]
 		r.RUnlock()
@@ -125,6 +130,11 @@ func (r *routes) lookupOrCalculate(name PeerName, broadcast *broadcastRoutes, es
 		(*broadcast)[name] = hops
 		r.Unlock()
 	}
+	select {
+	case r.action <- action:
+	case <-r.quit:
+		return []PeerName{}
+	}
 	return <-res
 }
 
@@ -140,7 +150,7 @@ func (r *routes) lookupOrCalculate(name PeerName, broadcast *broadcastRoutes, es
 // sparsely connected peers this function returns a higher proportion of
 // neighbours than elsewhere. In extremis, on peers with fewer than
 // log2(n_peers) neighbours, all neighbours are returned.
-func (r *routes) randomNeighbours(except PeerName) []PeerName {
+func (r *routes) randomNeighbours(except PeerName, fanout int) []PeerName {
 	r.RLock()
 	defer r.RUnlock()
 	var total int64 = 0
@@ -152,7 +162,11 @@ func (r *routes) randomNeighbours(except PeerName) []PeerName {
 			weights[dst]++
 		}
 	}
-	needed := int(math.Min(2*math.Log2(float64(len(r.unicastAll))), float64(len(weights))))
+	needed := fanout
+	if needed <= 0 {
+		needed = int(2 * math.Log2(float64(len(r.unicastAll))))
+	}
+	needed = int(math.Min(float64(needed), float64(len(weights))))
 	destinations := make([]PeerName, 0, needed)
 	for len(destinations) < needed {
 		// Pick a random point on the distribution and linear search for it
@@ -198,13 +212,30 @@ func (r *routes) ensureRecalculated() {
 	default:
 		done = make(chan struct{})
 	}
-	r.wait <- done
-	<-done
+	select {
+	case r.wait <- done:
+	case <-r.quit:
+		return
+	}
+	select {
+	case <-done:
+	case <-r.quit:
+	}
+}
+
+// stop terminates the recalculation actor and waits for it to finish.
+func (r *routes) stop() {
+	close(r.quit)
+	<-r.finished
 }
 
 func (r *routes) run(wait <-chan chan struct{}, action <-chan func()) {
+	defer close(r.finished)
 	for {
 		select {
+		case <-r.quit:
+			r.recalcTimer.Stop()
+			return
 		case <-r.recalcTimer.C:
 			r.clearPendingRecalcFlag()
 			r.calculate()
@@ -241,6 +272,11 @@ func (r *routes) calculate() {
 	r.peers.RUnlock()
 
 	r.Lock()
+	// The broadcast routes of other peers are calculated lazily, so only
+	// our own can be compared.
+	changed := !unicast.equal(r.unicast) || !unicastAll.equal(r.unicastAll) ||
+		!equalHops(broadcast[r.ourself.Name], r.broadcast[r.ourself.Name]) ||
+		!equalHops(broadcastAll[r.ourself.Name], r.broadcastAll[r.ourself.Name])
 	r.unicast = unicast
 	r.unicastAll = unicastAll
 	r.broadcast = broadcast
@@ -248,11 +284,40 @@ func (r *routes) calculate() {
 	onChange := r.onChange
 	r.Unlock()
 
+	// Outside the lock, since callbacks may look up routes.
+	if !changed {
+		return
+	}
 	for _, callback := range onChange {
 		callback()
 	}
 }
 
+func (routes unicastRoutes) equal(other unicastRoutes) bool {
+	if len(routes) != len(other) {
+		return false
+	}
+	for name, hop := range routes {
+		if otherHop, found := other[name]; !found || otherHop != hop {
+			return false
+		}
+	}
+	return true
+}
+
+// equalHops compares broadcast hops, which are sorted.
+func equalHops(hops, other []PeerName) bool {
+	if len(hops) != len(other) {
+		return false
+	}
+	for i := range hops {
+		if hops[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Calculate all the routes for the question: if *we* want to send a
 // packet to Peer X, what is the next hop?
 //
@@ -262,9 +327,18 @@ func (r *routes) calculate() {
 // any knowledge of the MAC address at all. Thus there's no need
 // to exchange knowledge of MAC addresses, nor any constraints on
 // the routes that we construct.
+//
+// Peers which predate weightedRoutes route by hops, so until every peer
+// routes by RTT, such as during a rolling upgrade, we do likewise, lest
+// we route in cycles with them.
 func (r *routes) calculateUnicast(establishedAndSymmetric bool) unicastRoutes {
-	_, unicast := r.ourself.routes(nil, establishedAndSymmetric)
-	return unicast
+	for _, peer := range r.peers.byName {
+		if !peer.WeightedRoutes {
+			_, unicast := r.ourself.routes(nil, establishedAndSymmetric)
+			return unicast
+		}
+	}
+	return r.ourself.weightedRoutes(establishedAndSymmetric)
 }
 
 // Calculate the route to answer the question: if we receive a
@@ -295,5 +369,7 @@ func (r *routes) calculateBroadcast(name PeerName, establishedAndSymmetric bool)
 		r.ourself.forEachConnectedPeer(establishedAndSymmetric, reached,
 			func(remotePeer *Peer) { hops = append(hops, remotePeer.Name) })
 	}
+	// In a consistent order, so that changes can be detected.
+	sort.Slice(hops, func(i, j int) bool { return hops[i] < hops[j] })
 	return hops
 }
@@ -0,0 +1,215 @@
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/branthz/utarrow/lib/log"
+)
+
+// RPCHandler answers a request made with RPCChannel.Call by the peer src.
+// A non-nil error is returned to the caller as an *RPCError.
+type RPCHandler func(src PeerName, req []byte) ([]byte, error)
+
+// RPCError is returned by RPCChannel.Call when the remote handler fails.
+type RPCError struct {
+	Peer    PeerName
+	Message string
+}
+
+func (err *RPCError) Error() string {
+	return fmt.Sprintf("rpc to %s failed: %s", err.Peer, err.Message)
+}
+
+// RPCChannel makes requests of other peers, and answers theirs, over a
+// gossip channel of its own. Requests and responses are gossip unicasts,
+// and so are relayed by intermediate peers when there is no direct
+// connection. Each starts with a kind byte and a uvarint call ID, which
+// correlates responses with requests, followed by the request, the
+// response or the error message. Call IDs are random, so that no peer
+// but the one called can guess them, and a response is only accepted
+// from the peer called. At most maxConcurrentRPCs requests are handled
+// at once; requests beyond that are dropped, and their callers time out.
+type RPCChannel struct {
+	router   *Router
+	gossip   Gossip
+	handler  RPCHandler
+	handling chan struct{} // a token per request being handled
+
+	sync.Mutex
+	pending map[uint64]pendingCall
+}
+
+type pendingCall struct {
+	dst        PeerName
+	resultChan chan<- rpcResult
+}
+
+const maxConcurrentRPCs = 64
+
+const (
+	rpcRequest byte = iota
+	rpcResponse
+	rpcErrorResponse
+)
+
+type rpcResult struct {
+	resp []byte
+	err  error
+}
+
+// NewRPCChannel returns an RPCChannel using the named gossip channel,
+// whose requests are answered by handler. handler may be nil if the peer
+// only makes requests; requests made of it then fail.
+func (router *Router) NewRPCChannel(channelName string, handler RPCHandler) (*RPCChannel, error) {
+	c := &RPCChannel{
+		router:   router,
+		handler:  handler,
+		handling: make(chan struct{}, maxConcurrentRPCs),
+		pending:  make(map[uint64]pendingCall),
+	}
+	// Requests and responses are all unicasts, so there is no state to
+	// gossip periodically.
+	gossip, err := router.NewGossipWithConfig(channelName, c, GossipConfig{NoPeriodicGossip: true})
+	if err != nil {
+		return nil, err
+	}
+	c.gossip = gossip
+	return c, nil
+}
+
+// Call sends req to the peer dst and waits for its response, until ctx is
+// done.
+func (c *RPCChannel) Call(ctx context.Context, dst PeerName, req []byte) ([]byte, error) {
+	if dst == c.router.Ourself.Name {
+		return c.handle(dst, req)
+	}
+
+	resultChan := make(chan rpcResult, 1)
+	c.Lock()
+	id := randUint64()
+	for _, found := c.pending[id]; found; _, found = c.pending[id] {
+		id = randUint64()
+	}
+	c.pending[id] = pendingCall{dst, resultChan}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+	}()
+
+	if err := c.gossip.GossipUnicast(dst, makeRPCMsg(rpcRequest, id, req)); err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-resultChan:
+		return result.resp, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RPCChannel) handle(src PeerName, req []byte) ([]byte, error) {
+	if c.handler == nil {
+		return nil, &RPCError{c.router.Ourself.Name, "no handler"}
+	}
+	resp, err := c.handler(src, req)
+	if err != nil {
+		return nil, &RPCError{c.router.Ourself.Name, err.Error()}
+	}
+	return resp, nil
+}
+
+func makeRPCMsg(kind byte, id uint64, body []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(body))
+	buf[0] = kind
+	n := 1 + binary.PutUvarint(buf[1:], id)
+	return append(buf[:n], body...)
+}
+
+// OnGossipUnicast implements Gossiper. Requests are handled in their own
+// goroutine, so as not to hold up the connection they arrived on, up to
+// maxConcurrentRPCs at once.
+func (c *RPCChannel) OnGossipUnicast(src PeerName, msg []byte) error {
+	if len(msg) < 1 {
+		return fmt.Errorf("empty rpc msg from %s", src)
+	}
+	id, n := binary.Uvarint(msg[1:])
+	if n <= 0 {
+		return fmt.Errorf("malformed rpc msg from %s", src)
+	}
+	kind, body := msg[0], msg[1+n:]
+
+	switch kind {
+	case rpcRequest:
+		select {
+		case c.handling <- struct{}{}:
+		default:
+			log.Info("[rpc] too many requests; dropping one from %s", src)
+			return nil
+		}
+		if !c.router.track() {
+			<-c.handling
+			return nil // stopping
+		}
+		go func() {
+			defer func() { <-c.handling }()
+			defer c.router.untrack()
+			resp, err := c.handle(src, body)
+			reply := makeRPCMsg(rpcResponse, id, resp)
+			if err != nil {
+				reply = makeRPCMsg(rpcErrorResponse, id, []byte(err.(*RPCError).Message))
+			}
+			if err := c.gossip.GossipUnicast(src, reply); err != nil {
+				log.Info("[rpc] unable to respond to %s: %v", src, err)
+			}
+		}()
+		return nil
+	case rpcResponse, rpcErrorResponse:
+		result := rpcResult{resp: body}
+		if kind == rpcErrorResponse {
+			result = rpcResult{err: &RPCError{src, string(body)}}
+		}
+		c.Lock()
+		call, found := c.pending[id]
+		if found && call.dst == src {
+			delete(c.pending, id)
+		}
+		c.Unlock()
+		if !found || call.dst != src {
+			log.Info("[rpc] ignoring unexpected response from %s", src)
+			return nil // the caller gave up, or it is not the peer called
+		}
+		// Never blocks, as the entry was deleted before delivering the
+		// one result to its buffer.
+		select {
+		case call.resultChan <- result:
+		default:
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rpc msg kind %d from %s", kind, src)
+}
+
+// OnGossipBroadcast implements Gossiper. An RPCChannel does not broadcast,
+// but a broadcast is only logged, since an error would break the
+// connection it arrived on.
+func (c *RPCChannel) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	log.Info("[rpc] ignoring unexpected broadcast from %s", src)
+	return nil, nil
+}
+
+// Gossip implements Gossiper. An RPCChannel has no state to gossip.
+func (c *RPCChannel) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper. An RPCChannel does not gossip, but as for
+// OnGossipBroadcast, gossip is only logged.
+func (c *RPCChannel) OnGossip(msg []byte) (GossipData, error) {
+	log.Info("[rpc] ignoring unexpected gossip")
+	return nil, nil
+}
@@ -0,0 +1,117 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPC(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	var channels []*RPCChannel
+	for i := 1; i <= 3; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		channel, err := router.NewRPCChannel("rpc", func(src PeerName, req []byte) ([]byte, error) {
+			switch string(req) {
+			case "fail":
+				return nil, fmt.Errorf("failed as asked")
+			case "hang":
+				time.Sleep(time.Second)
+			}
+			return []byte(fmt.Sprintf("%s from %s to %s", req, src, name)), nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers, channels = append(routers, router), append(channels, channel)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	_, err := routers[0].NewRPCChannel("rpc", nil)
+	require.Error(t, err, "duplicate channel")
+
+	// A line, so that calls between the ends are relayed by the middle.
+	routers[1].ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String(), routers[2].Addr().String()}, true)
+	first, last := routers[0].Ourself.Name, routers[2].Ourself.Name
+	waitFor(t, "routes", func() bool {
+		_, there := routers[0].Routes.UnicastAll(last)
+		_, back := routers[2].Routes.UnicastAll(first)
+		return there && back
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := channels[0].Call(ctx, last, []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("hello from %s to %s", first, last), string(resp))
+
+	_, err = channels[2].Call(ctx, first, []byte("fail"))
+	require.Equal(t, &RPCError{first, "failed as asked"}, err)
+
+	resp, err = channels[0].Call(ctx, first, []byte("self"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("self from %s to %s", first, first), string(resp))
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	_, err = channels[0].Call(shortCtx, last, []byte("hang"))
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	unknown, _ := PeerNameFromString("ff:00:00:00:00:01")
+	_, err = channels[0].Call(ctx, unknown, []byte("hello"))
+	require.Error(t, err)
+
+	// Responses are only accepted from the peer called, and only once.
+	c := channels[0]
+	resultChan := make(chan rpcResult, 1)
+	c.Lock()
+	c.pending[42] = pendingCall{last, resultChan}
+	c.Unlock()
+	require.NoError(t, c.OnGossipUnicast(routers[1].Ourself.Name, makeRPCMsg(rpcResponse, 42, []byte("forged"))))
+	require.Empty(t, resultChan)
+	require.NoError(t, c.OnGossipUnicast(last, makeRPCMsg(rpcResponse, 42, []byte("genuine"))))
+	require.NoError(t, c.OnGossipUnicast(last, makeRPCMsg(rpcResponse, 42, []byte("again"))))
+	require.Equal(t, rpcResult{resp: []byte("genuine")}, <-resultChan)
+	require.Empty(t, c.pending)
+
+	_, err = c.OnGossipBroadcast(last, []byte("broadcast"))
+	require.NoError(t, err, "stray gossip should not break the connection")
+}
+
+func TestRPCConcurrency(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:00:00:01")
+	router, err := NewRouter(Config{Host: "10.0.0.1", Port: Port, Transport: NewMemTransport()}, name, "1", nil)
+	require.NoError(t, err)
+	unblock := make(chan struct{})
+	handling := make(chan struct{}, 2*maxConcurrentRPCs)
+	c, err := router.NewRPCChannel("rpc", func(src PeerName, req []byte) ([]byte, error) {
+		handling <- struct{}{}
+		<-unblock
+		return nil, nil
+	})
+	require.NoError(t, err)
+	defer router.Stop(context.Background())
+	src, _ := PeerNameFromString("02:00:00:00:00:01")
+
+	// Those beyond the limit are dropped rather than queued.
+	for id := uint64(0); id < 2*maxConcurrentRPCs; id++ {
+		require.NoError(t, c.OnGossipUnicast(src, makeRPCMsg(rpcRequest, id, nil)))
+	}
+	waitFor(t, "handlers", func() bool { return len(handling) == maxConcurrentRPCs })
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, maxConcurrentRPCs, len(handling))
+
+	close(unblock)
+	waitFor(t, "tokens returned", func() bool { return len(c.handling) == 0 })
+	require.NoError(t, c.OnGossipUnicast(src, makeRPCMsg(rpcRequest, 0, nil)))
+	waitFor(t, "handled after", func() bool { return len(handling) == maxConcurrentRPCs+1 })
+}
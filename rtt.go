@@ -0,0 +1,129 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Connections whose remote has the "HeartbeatEcho" feature measure their
+// RTT with a ProtocolHeartbeatEcho request when established and with every
+// heartbeat thereafter, which the remote echoes. The payload of both is a
+// kind byte followed by the time the request was sent, as a uint64 count
+// of nanoseconds since the connection was created.
+//
+// Requests and echoes wait their turn behind whatever else is being sent,
+// at either end, so a sample is the RTT plus any such queueing. Since that
+// only ever adds to it, the RTT is taken as the least of the latest
+// rttWindowSize samples, so that a lasting change of latency shows within
+// as many heartbeats, but a passing burst of traffic does not.
+//
+// The RTT is gossiped in the connection's summary for weightedRoutes.
+// Since changing it means a topology update, it is gossiped anew only once
+// it has changed by over a quarter, and by at least rttMinChange.
+const (
+	echoRequest byte = iota
+	echoReply
+)
+
+const (
+	rttWindowSize = 10
+	rttMinChange  = 2 * time.Millisecond
+)
+
+var errMalformedEcho = fmt.Errorf("malformed heartbeat echo")
+
+// sendEchoRequest must only be called from the actor.
+func (conn *LocalConnection) sendEchoRequest() error {
+	if !conn.echoes {
+		return nil
+	}
+	payload := make([]byte, 9)
+	payload[0] = echoRequest
+	binary.BigEndian.PutUint64(payload[1:], uint64(time.Since(conn.created)))
+	return conn.sendProtocolMsg(protocolMsg{ProtocolHeartbeatEcho, payload})
+}
+
+// handleHeartbeatEcho must only be called from the receiveTCP goroutine.
+func (conn *LocalConnection) handleHeartbeatEcho(payload []byte) error {
+	if len(payload) != 9 {
+		return errMalformedEcho
+	}
+	switch payload[0] {
+	case echoRequest:
+		// Sending from here could deadlock with the remote doing
+		// likewise, so leave it to the actor. Should an echo still be
+		// waiting, this request goes unanswered.
+		reply := append([]byte{echoReply}, payload[1:]...)
+		select {
+		case conn.echoChan <- reply:
+		default:
+		}
+		return nil
+	case echoReply:
+	default:
+		return errMalformedEcho
+	}
+	sample := time.Since(conn.created) - time.Duration(binary.BigEndian.Uint64(payload[1:]))
+	if sample < 0 {
+		return errMalformedEcho
+	}
+	rtt := conn.rttSamples.add(sample)
+	gossiped := conn.rtt()
+	change := rtt - gossiped
+	if change < 0 {
+		change = -change
+	}
+	if gossiped != 0 && (change < rttMinChange || change <= gossiped/4) {
+		return nil
+	}
+	atomic.StoreInt64(&conn.rttNanos, int64(rtt))
+	conn.router.Ourself.doRTTChanged()
+	return nil
+}
+
+// rttSamples are the latest RTT samples of a connection, a ring.
+type rttSamples struct {
+	samples []time.Duration
+	next    int // where the next sample goes, once full
+}
+
+// add records sample, returning the least of the latest samples.
+func (s *rttSamples) add(sample time.Duration) time.Duration {
+	if len(s.samples) < rttWindowSize {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % rttWindowSize
+	}
+	least := s.samples[0]
+	for _, sample := range s.samples[1:] {
+		if sample < least {
+			least = sample
+		}
+	}
+	return least
+}
+
+// rtt returns the RTT as last gossiped, or zero if not yet measured.
+func (conn *LocalConnection) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.rttNanos))
+}
+
+// Asynchronous.
+func (peer *localPeer) doRTTChanged() {
+	peer.actionChan <- func() {
+		peer.handleRTTChanged()
+	}
+}
+
+// handleRTTChanged gossips the changed RTT of one of our connections,
+// which is taken afresh when the topology update is encoded.
+func (peer *localPeer) handleRTTChanged() {
+	peer.Lock()
+	peer.Version++
+	peer.Unlock()
+	peer.router.Routes.recalculate()
+	peer.broadcastPeerUpdate()
+}
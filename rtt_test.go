@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionRTT(t *testing.T) {
+	network := NewMemTransport()
+	var routers []*Router
+	for i := 1; i <= 2; i++ {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i))
+		require.NoError(t, err)
+		router, err := NewRouter(Config{Host: fmt.Sprintf("10.0.0.%d", i), Port: Port, Transport: network}, name, fmt.Sprint(i), nil)
+		require.NoError(t, err)
+		require.NoError(t, router.Start())
+		routers = append(routers, router)
+	}
+	defer func() {
+		for _, router := range routers {
+			require.NoError(t, router.Stop(context.Background()))
+		}
+	}()
+	routers[1].ConnectionMaker.InitiateConnections([]string{routers[0].Addr().String()}, true)
+
+	// Each end measures the RTT once established, and gossips it.
+	for i, router := range routers {
+		remote := routers[1-i]
+		waitFor(t, "RTT measured", func() bool {
+			conn, found := router.Ourself.ConnectionTo(remote.Ourself.Name)
+			return found && conn.(*LocalConnection).rtt() > 0
+		})
+		waitFor(t, "RTT gossiped", func() bool {
+			for _, peer := range NewStatus(remote).Peers {
+				if peer.Name == router.Ourself.Name.String() {
+					return len(peer.Connections) == 1 && peer.Connections[0].RTT > 0
+				}
+			}
+			return false
+		})
+	}
+	for _, conn := range NewStatus(routers[0]).Connections {
+		require.True(t, conn.RTT > 0, conn.Address)
+	}
+}
+
+func TestRTTSamples(t *testing.T) {
+	var s rttSamples
+	require.Equal(t, 5*time.Millisecond, s.add(5*time.Millisecond))
+	// Queueing delays are ignored while a faster sample is in the window.
+	require.Equal(t, 5*time.Millisecond, s.add(50*time.Millisecond))
+	require.Equal(t, 3*time.Millisecond, s.add(3*time.Millisecond))
+	// A lasting change shows once the window has passed.
+	for i := 0; i < rttWindowSize-1; i++ {
+		require.Equal(t, 3*time.Millisecond, s.add(20*time.Millisecond))
+	}
+	require.Equal(t, 20*time.Millisecond, s.add(20*time.Millisecond))
+	require.Len(t, s.samples, rttWindowSize)
+}
@@ -3,6 +3,7 @@ package mesh
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 // Status is our current state as a peer, as taken from a router.
@@ -24,10 +25,18 @@ type Status struct {
 	Targets            []string
 	OverlayDiagnostics interface{}
 	TrustedSubnets     []string
+	Passwords          int // how many passwords we accept, current included
+	// AcceptError is why we stopped accepting connections, should the
+	// listener have failed while the router is running.
+	AcceptError string
 }
 
 // NewStatus returns a Status object, taken as a snapshot from the router.
 func NewStatus(router *Router) *Status {
+	var acceptError string
+	if err := router.acceptError(); err != nil {
+		acceptError = err.Error()
+	}
 	return &Status{
 		Protocol:           Protocol,
 		ProtocolMinVersion: int(router.ProtocolMinVersion),
@@ -45,6 +54,8 @@ func NewStatus(router *Router) *Status {
 		Targets:            router.ConnectionMaker.Targets(false),
 		OverlayDiagnostics: router.Overlay.Diagnostics(),
 		TrustedSubnets:     makeTrustedSubnetsSlice(router.TrustedSubnets),
+		Passwords:          countPasswords(router),
+		AcceptError:        acceptError,
 	}
 }
 
@@ -56,6 +67,7 @@ type PeerStatus struct {
 	ShortID     PeerShortID
 	Version     uint64
 	Connections []connectionStatus
+	Metadata    map[string]string
 }
 
 // makePeerStatusSlice takes a snapshot of the state of peers.
@@ -83,6 +95,7 @@ func makePeerStatusSlice(peers *Peers) []PeerStatus {
 			peer.ShortID,
 			peer.Version,
 			connections,
+			copyMetadata(peer.Metadata),
 		})
 	})
 
@@ -95,6 +108,7 @@ type connectionStatus struct {
 	Address     string
 	Outbound    bool
 	Established bool
+	RTT         time.Duration
 }
 
 func makeConnectionStatus(c Connection) connectionStatus {
@@ -104,6 +118,7 @@ func makeConnectionStatus(c Connection) connectionStatus {
 		Address:     c.remoteTCPAddress(),
 		Outbound:    c.isOutbound(),
 		Established: c.isEstablished(),
+		RTT:         c.rtt(),
 	}
 }
 
@@ -153,6 +168,32 @@ type LocalConnectionStatus struct {
 	State    string
 	Info     string
 	Attrs    map[string]interface{}
+	// PasswordIndex is which of the passwords we accepted when the
+	// connection was made the remote encrypts with: 0 for the current
+	// one, then the previous ones in the order given to SetPasswords. It
+	// is -1 without a password.
+	PasswordIndex int
+	// Number of times the session key was replaced for what we send
+	// and receive, respectively.
+	SendRekeys    uint64
+	ReceiveRekeys uint64
+	// Compression is the algorithm we compress with, if any. The byte
+	// counts cover all msgs sent, compressed or not.
+	Compression            string
+	BytesBeforeCompression uint64
+	BytesAfterCompression  uint64
+	// Gossip dropped for want of room in the connection's queues, in
+	// bytes and in GossipData discarded.
+	GossipDroppedBytes uint64
+	GossipDrops        uint64
+	// RTT is the least round trip time measured on the connection of
+	// late, as last gossiped; zero until measured.
+	RTT time.Duration
+	// Phi is the suspicion that the remote has failed, from the arrival
+	// times of its heartbeats and other msgs, in the manner of a phi
+	// accrual failure detector: a phi of 1 means a 10% chance of a false
+	// suspicion, 2 of 1%, and so on. See Config.PhiThreshold.
+	Phi float64
 }
 
 // makeLocalConnectionStatusSlice takes a snapshot of the active local
@@ -173,7 +214,7 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 				name = "none"
 			}
 			info := fmt.Sprintf("%-6v %v", name, conn.Remote())
-			if lc.router.usingPassword() {
+			if lc.router.usingPassword() || lc.sessionKey != nil {
 				if lc.untrusted() {
 					info = fmt.Sprintf("%-11v %v", "encrypted", info)
 					if attrs != nil {
@@ -183,11 +224,34 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 					info = fmt.Sprintf("%-11v %v", "unencrypted", info)
 				}
 			}
-			slice = append(slice, LocalConnectionStatus{conn.remoteTCPAddress(), conn.isOutbound(), state, info, attrs})
+			sendRekeys, receiveRekeys := lc.rekeyCounts()
+			var compression string
+			if lc.compressing {
+				compression = compressionDeflate
+			}
+			before, after := lc.compression.get()
+			droppedBytes, drops := lc.senders.queue.droppedStats()
+			slice = append(slice, LocalConnectionStatus{
+				Address:                conn.remoteTCPAddress(),
+				Outbound:               conn.isOutbound(),
+				State:                  state,
+				Info:                   info,
+				Attrs:                  attrs,
+				PasswordIndex:          lc.passwordIndex,
+				SendRekeys:             sendRekeys,
+				ReceiveRekeys:          receiveRekeys,
+				Compression:            compression,
+				BytesBeforeCompression: before,
+				BytesAfterCompression:  after,
+				GossipDroppedBytes:     droppedBytes,
+				GossipDrops:            drops,
+				RTT:                    lc.rtt(),
+				Phi:                    lc.heartbeats.phi(time.Now()),
+			})
 		}
 		for address, target := range cm.targets {
 			add := func(state, info string) {
-				slice = append(slice, LocalConnectionStatus{address, true, state, info, nil})
+				slice = append(slice, LocalConnectionStatus{Address: address, Outbound: true, State: state, Info: info})
 			}
 			switch target.state {
 			case targetWaiting:
@@ -224,3 +288,14 @@ func makeTrustedSubnetsSlice(trustedSubnets []*net.IPNet) []string {
 	}
 	return trustedSubnetStrs
 }
+
+// countPasswords counts the passwords the router accepts. Rather than
+// fingerprints, which would allow offline guessing, connections identify
+// theirs by index.
+func countPasswords(router *Router) int {
+	current, previous := router.getPasswords()
+	if current == nil {
+		return 0
+	}
+	return 1 + len(previous)
+}
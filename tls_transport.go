@@ -0,0 +1,143 @@
+package mesh
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLSTransport implements Transport by securing the streams of another
+// Transport with mutually authenticated TLS. Every peer must present a
+// certificate signed by the mesh's certificate authority, whose Subject
+// Common Name is the peer's name. When the connection's intro completes,
+// a remote claiming any other name is rejected.
+type TLSTransport struct {
+	inner        Transport
+	clientConfig *tls.Config
+	serverConfig *tls.Config
+}
+
+var _ Transport = &TLSTransport{}
+
+// NewTLSTransport returns a TLSTransport layered over inner, or over
+// TCPTransport if inner is nil. config must supply our certificate in
+// Certificates and the mesh's certificate authority in RootCAs; ClientCAs,
+// if set, is used instead of RootCAs to verify accepted connections. As
+// certificates identify peers rather than hosts, server names are not
+// checked. Since every peer both dials and accepts, certificates must
+// allow both server and client authentication.
+func NewTLSTransport(inner Transport, config *tls.Config) *TLSTransport {
+	if inner == nil {
+		inner = TCPTransport{}
+	}
+	clientConfig := config.Clone()
+	clientConfig.InsecureSkipVerify = true // we verify the chain ourselves, minus the host name
+	clientConfig.VerifyPeerCertificate = verifyPeerCertificate(config.RootCAs, x509.ExtKeyUsageServerAuth)
+
+	serverConfig := config.Clone()
+	serverConfig.ClientAuth = tls.RequireAnyClientCert
+	clientCAs := config.ClientCAs
+	if clientCAs == nil {
+		clientCAs = config.RootCAs
+	}
+	serverConfig.VerifyPeerCertificate = verifyPeerCertificate(clientCAs, x509.ExtKeyUsageClientAuth)
+
+	return &TLSTransport{inner: inner, clientConfig: clientConfig, serverConfig: serverConfig}
+}
+
+// Dial implements Transport.
+func (t *TLSTransport) Dial(localAddr, addr string) (net.Conn, error) {
+	netConn, err := t.inner.Dial(localAddr, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(netConn, t.clientConfig)
+	if err := tlsConn.SetDeadline(time.Now().Add(headerTimeout)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Listen implements Transport. The handshake of accepted connections
+// happens during the protocol intro.
+func (t *TLSTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, t.serverConfig), nil
+}
+
+// verifyPeerCertificate returns a function verifying that the remote's
+// certificate chains to roots, permits usage, and names a peer.
+func verifyPeerCertificate(roots *x509.CertPool, usage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errNoPeerCertificate
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return err
+		}
+		_, err := peerNameFromCertificate(certs[0])
+		return err
+	}
+}
+
+// peerNameFromCertificate returns the peer name a certificate was issued to.
+func peerNameFromCertificate(cert *x509.Certificate) (PeerName, error) {
+	name, err := PeerNameFromString(cert.Subject.CommonName)
+	if err != nil {
+		return UnknownPeerName, fmt.Errorf("certificate common name %q is not a peer name: %v", cert.Subject.CommonName, err)
+	}
+	return name, nil
+}
+
+// checkCertifiedName verifies that, if netConn is secured by TLS, the
+// remote's certificate was issued to name.
+func checkCertifiedName(netConn net.Conn, name PeerName) error {
+	tlsConn, ok := netConn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errNoPeerCertificate
+	}
+	certName, err := peerNameFromCertificate(certs[0])
+	if err != nil {
+		return err
+	}
+	if certName != name {
+		return fmt.Errorf("remote claims to be %s, but its certificate is for %s", name, certName)
+	}
+	return nil
+}
+
+var errNoPeerCertificate = fmt.Errorf("remote presented no certificate")
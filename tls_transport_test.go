@@ -0,0 +1,128 @@
+package mesh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mesh test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a config with a certificate for commonName, permitting
+// usages, or both server and client authentication if none are given.
+func (ca *testCA) issue(t *testing.T, commonName string, usages ...x509.ExtKeyUsage) *tls.Config {
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+	}
+}
+
+func newTLSTestRouter(t *testing.T, network *MemTransport, host, name string, config *tls.Config) *Router {
+	peerName, err := PeerNameFromString(name)
+	require.NoError(t, err)
+	router, err := NewRouter(Config{Host: host, Port: Port, Transport: NewTLSTransport(network, config)}, peerName, host, nil)
+	require.NoError(t, err)
+	require.NoError(t, router.Start())
+	return router
+}
+
+func terminationCount(router *Router) int {
+	resultChan := make(chan int)
+	router.ConnectionMaker.actionChan <- func() bool {
+		resultChan <- router.ConnectionMaker.terminationCount
+		return false
+	}
+	return <-resultChan
+}
+
+func TestTLSTransport(t *testing.T) {
+	const (
+		name1 = "01:00:00:01:00:00"
+		name2 = "02:00:00:02:00:00"
+		name3 = "03:00:00:03:00:00"
+		name5 = "05:00:00:05:00:00"
+	)
+	ca := newTestCA(t)
+	network := NewMemTransport()
+	r1 := newTLSTestRouter(t, network, "10.0.0.1", name1, ca.issue(t, name1))
+	r2 := newTLSTestRouter(t, network, "10.0.0.2", name2, ca.issue(t, name2))
+	// r3 claims to be name3, but holds a certificate for name1
+	r3 := newTLSTestRouter(t, network, "10.0.0.3", name3, ca.issue(t, name1))
+	// r4 holds a certificate for its own name, from the wrong CA
+	r4 := newTLSTestRouter(t, network, "10.0.0.4", "04:00:00:04:00:00", newTestCA(t).issue(t, "04:00:00:04:00:00"))
+	// r5 holds a certificate for its own name, for servers only
+	r5 := newTLSTestRouter(t, network, "10.0.0.5", name5, ca.issue(t, name5, x509.ExtKeyUsageServerAuth))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, router := range []*Router{r1, r2, r3, r4, r5} {
+			require.NoError(t, router.Stop(ctx))
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "connection", func() bool { return r2.Ourself.connectionCount() == 1 })
+
+	r3.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "impostor rejection", func() bool { return terminationCount(r2) >= 1 })
+
+	r4.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "untrusted CA rejection", func() bool { return terminationCount(r2) >= 2 })
+
+	r5.ConnectionMaker.InitiateConnections([]string{r2.Addr().String()}, true)
+	waitFor(t, "server certificate rejection", func() bool { return terminationCount(r2) >= 3 })
+
+	require.Equal(t, 1, r2.Ourself.connectionCount())
+	require.Equal(t, 0, r3.Ourself.connectionCount())
+	require.Equal(t, 0, r4.Ourself.connectionCount())
+	require.Equal(t, 0, r5.Ourself.connectionCount())
+}
@@ -0,0 +1,177 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Transport establishes the streams over which peers talk to each other.
+// Addresses are in host:port form; the ConnectionMaker relies on that to
+// default ports and to recognise inbound connections from known hosts.
+type Transport interface {
+	// Dial connects to the peer listening at addr. localAddr, if its host
+	// part is non-empty, is the address to dial from.
+	Dial(localAddr, addr string) (net.Conn, error)
+
+	// Listen returns a listener accepting connections on addr.
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCPTransport implements Transport with real TCP connections.
+// It is the default.
+type TCPTransport struct{}
+
+var _ Transport = TCPTransport{}
+
+// Dial implements Transport.
+func (TCPTransport) Dial(localAddr, addr string) (net.Conn, error) {
+	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTCP("tcp", localTCPAddr, remoteTCPAddr)
+}
+
+// Listen implements Transport.
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// MemTransport implements Transport with in-memory pipes, so that many
+// routers can form a mesh within a single process without using sockets.
+// All routers in such a mesh must share the same MemTransport, and should
+// each be configured with a distinct Host, which must be an IP address.
+type MemTransport struct {
+	sync.Mutex
+	listeners map[string]*memListener
+	nextPort  int
+}
+
+var _ Transport = &MemTransport{}
+
+// NewMemTransport returns a usable, empty in-memory network.
+func NewMemTransport() *MemTransport {
+	return &MemTransport{
+		listeners: make(map[string]*memListener),
+		nextPort:  32768,
+	}
+}
+
+// Dial implements Transport.
+func (t *MemTransport) Dial(localAddr, addr string) (net.Conn, error) {
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	t.Lock()
+	ln, found := t.listeners[remoteTCPAddr.String()]
+	localTCPAddr = t.complete(localTCPAddr)
+	t.Unlock()
+	if !found {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: remoteTCPAddr, Err: errMemConnRefused}
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case ln.accept <- &memConn{Conn: remote, local: remoteTCPAddr, remote: localTCPAddr}:
+		return &memConn{Conn: local, local: localTCPAddr, remote: remoteTCPAddr}, nil
+	case <-ln.closed:
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: remoteTCPAddr, Err: errMemConnRefused}
+	}
+}
+
+// Listen implements Transport. A zero port is replaced with an unused one.
+func (t *MemTransport) Listen(addr string) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.Lock()
+	defer t.Unlock()
+	tcpAddr = t.complete(tcpAddr)
+	key := tcpAddr.String()
+	if _, found := t.listeners[key]; found {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: tcpAddr, Err: errMemAddrInUse}
+	}
+	ln := &memListener{
+		transport: t,
+		addr:      tcpAddr,
+		accept:    make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[key] = ln
+	return ln, nil
+}
+
+// complete fills in an unspecified IP or port. Must hold the lock.
+func (t *MemTransport) complete(addr *net.TCPAddr) *net.TCPAddr {
+	completed := *addr
+	if completed.IP == nil || completed.IP.IsUnspecified() {
+		completed.IP = net.IPv4(127, 0, 0, 1)
+	}
+	if completed.Port == 0 {
+		completed.Port = t.nextPort
+		t.nextPort++
+	}
+	return &completed
+}
+
+var (
+	errMemConnRefused = fmt.Errorf("connection refused")
+	errMemAddrInUse   = fmt.Errorf("address already in use")
+	errMemClosed      = fmt.Errorf("use of closed listener")
+)
+
+type memListener struct {
+	transport *MemTransport
+	addr      *net.TCPAddr
+	accept    chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Accept implements net.Listener.
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.accept:
+		return conn, nil
+	case <-ln.closed:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: ln.addr, Err: errMemClosed}
+	}
+}
+
+// Close implements net.Listener.
+func (ln *memListener) Close() error {
+	ln.closeOnce.Do(func() {
+		ln.transport.Lock()
+		delete(ln.transport.listeners, ln.addr.String())
+		ln.transport.Unlock()
+		close(ln.closed)
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (ln *memListener) Addr() net.Addr { return ln.addr }
+
+// memConn is one end of a pipe, with TCP-shaped addresses so that it is
+// indistinguishable from a TCP connection to the rest of mesh.
+type memConn struct {
+	net.Conn
+	local, remote *net.TCPAddr
+}
+
+// LocalAddr implements net.Conn.
+func (c *memConn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr implements net.Conn.
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
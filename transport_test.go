@@ -0,0 +1,68 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemTransportMesh(t *testing.T) {
+	const n = 20
+	transport := NewMemTransport()
+	routers := make([]*Router, n)
+	for i := range routers {
+		name, err := PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:01", i+1))
+		require.NoError(t, err)
+		routers[i], err = NewRouter(Config{
+			Host:          fmt.Sprintf("10.0.0.%d", i+1),
+			Port:          Port,
+			PeerDiscovery: true,
+			Transport:     transport,
+		}, name, fmt.Sprint("mem", i), nil)
+		require.NoError(t, err)
+		require.NoError(t, routers[i].Start())
+	}
+	defer func() {
+		// Stop them together, since each drains its gossip to the others.
+		errs := make(chan error, n)
+		for _, router := range routers {
+			go func(router *Router) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				errs <- router.Stop(ctx)
+			}(router)
+		}
+		for range routers {
+			require.NoError(t, <-errs)
+		}
+	}()
+
+	// Join each router to its predecessor; discovery does the rest.
+	for i := 1; i < n; i++ {
+		routers[i].ConnectionMaker.InitiateConnections([]string{routers[i-1].Addr().String()}, true)
+	}
+	for _, router := range routers {
+		router := router
+		waitFor(t, "full membership", func() bool { return len(router.Peers.Descriptions()) == n })
+	}
+}
+
+func TestMemTransportErrors(t *testing.T) {
+	transport := NewMemTransport()
+	_, err := transport.Dial(":0", "10.0.0.1:6783")
+	require.Error(t, err)
+
+	ln, err := transport.Listen("10.0.0.1:6783")
+	require.NoError(t, err)
+	_, err = transport.Listen("10.0.0.1:6783")
+	require.Error(t, err)
+
+	require.NoError(t, ln.Close())
+	_, err = ln.Accept()
+	require.Error(t, err)
+	_, err = transport.Dial(":0", "10.0.0.1:6783")
+	require.Error(t, err)
+}